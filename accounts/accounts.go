@@ -0,0 +1,335 @@
+// Package accounts keeps the players' accounts in a local JSON file: their username, a hash of
+// their password or of their token, and the results they got while logged in. The passwords and
+// tokens themselves are never stored.
+package accounts
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// password hashing parameters, PBKDF2 with SHA-256 as recommended by OWASP
+const (
+	hash_scheme     = "pbkdf2-sha256"
+	hash_iterations = 600000
+	salt_length     = 16
+	key_length      = 32
+	token_length    = 32
+	min_password    = 8 // shortest password accepted, in bytes
+)
+
+// championship points for the first ten places
+var points = []int{25, 18, 15, 12, 10, 8, 6, 4, 2, 1}
+
+// errors returned when logging in, they do not tell whether the username exists
+var (
+	ErrBadLogin = errors.New("wrong username, password or token")
+	ErrTaken    = errors.New("the username is taken")
+)
+
+// type Stats: the results a player got while logged in
+type Stats struct {
+	Races    int     `json:"races"`
+	Finishes int     `json:"finishes"`
+	Wins     int     `json:"wins"`
+	Podiums  int     `json:"podiums"`
+	Points   int     `json:"points"`   // championship points
+	BestLap  float64 `json:"best_lap"` // in seconds, zero until a lap is completed
+}
+
+// type Account: a player's account
+type Account struct {
+	Username string `json:"username"`
+	Password string `json:"password,omitempty"` // scheme, iterations, salt and hash of the password
+	Token    string `json:"token,omitempty"`    // SHA-256 of the token, tokens are random so they need no salt
+	Stats    Stats  `json:"stats"`
+}
+
+// func ID: the identity of the player that does not change from a connection to the next
+// input: none
+// output: the account's id
+func (account Account) ID() string {
+	return "account:" + strings.ToLower(account.Username)
+}
+
+// type Result: what a player got in a race
+type Result struct {
+	Place    int     // place in the classification, zero if the racer did not finish
+	Finished bool    // the racer crossed the line at the end of the race
+	BestLap  float64 // fastest lap, in seconds, zero if the racer did not complete one
+}
+
+// type Store: the accounts, saved to a file on every change
+type Store struct {
+	path     string
+	mu       sync.Mutex
+	accounts map[string]*Account // keyed by lower case username
+}
+
+// func Open: loads the accounts from a file, a file that does not exist yet is an empty store
+// input: the path of the file
+// output: a pointer to a Store object, or an error if the file could not be read
+func Open(path string) (*Store, error) {
+	store := &Store{path: path, accounts: map[string]*Account{}}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []*Account{}
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, fmt.Errorf("%s is not an accounts file: %w", path, err)
+	}
+	for _, account := range accounts {
+		store.accounts[strings.ToLower(account.Username)] = account
+	}
+	return store, nil
+}
+
+// func Register: creates an account with a password
+// input: the username, already checked by the caller, and the password
+// output: a copy of the Account object, or an error if the username is taken or the password too short
+func (store *Store) Register(username string, password string) (Account, error) {
+	if len(password) < min_password {
+		return Account{}, fmt.Errorf("passwords must be at least %d characters long", min_password)
+	}
+	hash, err := hash_password(password)
+	if err != nil {
+		return Account{}, err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	key := strings.ToLower(username)
+	if _, ok := store.accounts[key]; ok {
+		return Account{}, ErrTaken
+	}
+	account := &Account{Username: username, Password: hash}
+	store.accounts[key] = account
+
+	if err := store.save(); err != nil {
+		delete(store.accounts, key)
+		return Account{}, err
+	}
+	return *account, nil
+}
+
+// func Login: checks a username and its password
+// input: the username and the password
+// output: a copy of the Account object, or ErrBadLogin
+func (store *Store) Login(username string, password string) (Account, error) {
+	store.mu.Lock()
+	account, ok := store.accounts[strings.ToLower(username)]
+	hash := ""
+	if ok {
+		hash = account.Password
+	}
+	store.mu.Unlock()
+
+	// an unknown username is checked against a hash too, so it takes as long as a known one
+	if !ok {
+		hash = dummy_hash()
+	}
+
+	// the slow hash is checked outside the lock so logins do not wait for each other
+	if !check_password(hash, password) || !ok {
+		return Account{}, ErrBadLogin
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return *account, nil
+}
+
+// func LoginToken: finds the account a token was issued for
+// input: the token
+// output: a copy of the Account object, or ErrBadLogin
+func (store *Store) LoginToken(token string) (Account, error) {
+	hash := hash_token(token)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, account := range store.accounts {
+		if account.Token != "" && subtle.ConstantTimeCompare([]byte(account.Token), []byte(hash)) == 1 {
+			return *account, nil
+		}
+	}
+	return Account{}, ErrBadLogin
+}
+
+// func Exists: tells if there is an account with a username, whatever its case
+// input: the username
+// output: true if the account exists
+func (store *Store) Exists(username string) bool {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	_, ok := store.accounts[strings.ToLower(username)]
+	return ok
+}
+
+// func IssueToken: gives an account a new token, the one it had (if any) stops working
+// input: the username
+// output: the token, which is not stored and cannot be shown again, or an error if there is no such account
+func (store *Store) IssueToken(username string) (string, error) {
+	secret := make([]byte, token_length)
+	rand.Read(secret)
+	token := hex.EncodeToString(secret)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	account, ok := store.accounts[strings.ToLower(username)]
+	if !ok {
+		return "", fmt.Errorf("there is no account named %q", username)
+	}
+	previous := account.Token
+	account.Token = hash_token(token)
+
+	if err := store.save(); err != nil {
+		account.Token = previous
+		return "", err
+	}
+	return token, nil
+}
+
+// func Record: adds the result of a race to an account's stats
+// input: the username and the Result object
+// output: the updated Stats object, or an error if there is no such account or it could not be saved
+func (store *Store) Record(username string, result Result) (Stats, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	account, ok := store.accounts[strings.ToLower(username)]
+	if !ok {
+		return Stats{}, fmt.Errorf("there is no account named %q", username)
+	}
+
+	stats := &account.Stats
+	stats.Races++
+	if result.Finished {
+		stats.Finishes++
+		if result.Place == 1 {
+			stats.Wins++
+		}
+		if result.Place <= 3 {
+			stats.Podiums++
+		}
+		if result.Place >= 1 && result.Place <= len(points) {
+			stats.Points += points[result.Place-1]
+		}
+	}
+	if result.BestLap > 0 && (stats.BestLap == 0 || result.BestLap < stats.BestLap) {
+		stats.BestLap = result.BestLap
+	}
+
+	return *stats, store.save()
+}
+
+// func save: writes every account to the file, replacing it in one go so a crash cannot leave
+// half of it behind, the mutex must be held
+// input: none
+// output: an error if the file could not be written
+func (store *Store) save() error {
+	// sorted so the file only changes where the accounts do
+	accounts := []*Account{}
+	for _, account := range store.accounts {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(a, b int) bool {
+		return strings.ToLower(accounts[a].Username) < strings.ToLower(accounts[b].Username)
+	})
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	// the file holds password hashes, only its owner can read it
+	if err := file.Chmod(0600); err != nil {
+		file.Close()
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), store.path)
+}
+
+// func hash_password: hashes a password with a random salt
+// input: the password
+// output: the scheme, iterations, salt and hash separated by $, or an error if the hash failed
+func hash_password(password string) (string, error) {
+	salt := make([]byte, salt_length)
+	rand.Read(salt)
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, hash_iterations, key_length)
+	if err != nil {
+		return "", err
+	}
+	encode := base64.RawStdEncoding.EncodeToString
+	return strings.Join([]string{hash_scheme, strconv.Itoa(hash_iterations), encode(salt), encode(key)}, "$"), nil
+}
+
+// hash checked when logging in with an unknown username
+var dummy_hash = sync.OnceValue(func() string {
+	hash, _ := hash_password("")
+	return hash
+})
+
+// func check_password: tells if a password matches a hash made by hash_password
+// input: the hash and the password
+// output: true if the password matches
+func check_password(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != hash_scheme {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// func hash_token: the SHA-256 of a token, as stored in the account
+func hash_token(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
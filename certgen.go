@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"racer/certs"
+)
+
+var (
+	dir   = flag.String("dir", "tls", "directory to write the certificates and keys to")
+	hosts = flag.String("hosts", "localhost,127.0.0.1", "comma separated host names and IP addresses the server certificate is valid for")
+)
+
+// certificate generator's main function
+func main() {
+	flag.Parse()
+
+	// the server certificate needs at least one host to be checked against
+	names := []string{}
+	for _, host := range strings.Split(*hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			names = append(names, host)
+		}
+	}
+	if len(names) == 0 {
+		log.Fatal("hosts cannot be empty")
+	}
+
+	if err := certs.Generate(*dir, names); err != nil {
+		log.Fatal(err)
+	}
+
+	// tell the user how to use the files
+	fmt.Printf("Wrote a local CA, a server certificate for %s and a bot certificate to %s.\n", strings.Join(names, ", "), *dir)
+	fmt.Printf("Server: ./server.out -tlsCert %s -tlsKey %s -tlsClientCA %s\n",
+		filepath.Join(*dir, certs.ServerFile), filepath.Join(*dir, certs.ServerKeyFile), filepath.Join(*dir, certs.CAFile))
+	fmt.Printf("Client: ./client.out -tlsCA %s\n", filepath.Join(*dir, certs.CAFile))
+	fmt.Printf("Bot:    ./client.out -human=false -tlsCA %s -tlsCert %s -tlsKey %s\n",
+		filepath.Join(*dir, certs.CAFile), filepath.Join(*dir, certs.BotFile), filepath.Join(*dir, certs.BotKeyFile))
+}
@@ -0,0 +1,223 @@
+// Package certs builds the TLS configurations of the server and the client from PEM files,
+// and generates a small certificate authority with a server and a bot certificate to try
+// TLS out locally.
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// files written by Generate
+const (
+	CAFile        = "ca.pem"
+	CAKeyFile     = "ca-key.pem"
+	ServerFile    = "server.pem"
+	ServerKeyFile = "server-key.pem"
+	BotFile       = "bot.pem"
+	BotKeyFile    = "bot-key.pem"
+)
+
+// how long the generated certificates are valid for
+const validity = 365 * 24 * time.Hour
+
+// returned by CheckPeer for a client that must present a certificate and did not
+var ErrNoCertificate = errors.New("no client certificate signed by the server's CA was presented")
+
+// func Server: the TLS configuration of the server, clients that present a certificate signed
+// by the client CA are verified, the others are let in without one
+// input: the certificate and key files of the server, and the CA file of the clients (empty to ignore client certificates)
+// output: a pointer to the tls.Config object, or an error if a file could not be loaded
+func Server(cert string, key string, client_ca string) (*tls.Config, error) {
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the server certificate: %w", err)
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+	if client_ca != "" {
+		pool, err := load_pool(client_ca)
+		if err != nil {
+			return nil, err
+		}
+		// the server decides who needs a certificate once it knows the client's role
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// func Client: the TLS configuration of the client
+// input: the CA file the server certificate must be signed by (empty for the system's CAs), true to
+// skip checking the server certificate, and the certificate and key files of the client (empty for none)
+// output: a pointer to the tls.Config object, or an error if a file could not be loaded
+func Client(ca string, insecure bool, cert string, key string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+
+	// only the given CA is trusted, so a certificate from any other CA is refused
+	if ca != "" {
+		pool, err := load_pool(ca)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("could not load the client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// func Peer: the name of the verified certificate a client presented
+// input: the connection, after its handshake
+// output: the common name of the certificate, and false if the connection is not TLS or the client presented none
+func Peer(conn net.Conn) (string, bool) {
+	tls_conn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+	state := tls_conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// func CheckPeer: checks that a client which must present a certificate did, the server verified
+// it against the client CA during the handshake
+// input: the connection, after its handshake, and true if the client must present a certificate
+// output: the common name of the certificate (empty if there is none), or ErrNoCertificate
+func CheckPeer(conn net.Conn, required bool) (string, error) {
+	name, verified := Peer(conn)
+	if required && !verified {
+		return "", ErrNoCertificate
+	}
+	return name, nil
+}
+
+// func Generate: writes a CA, a server certificate for some hosts and a bot certificate signed by it
+// input: the directory to write the files to and the host names or IP addresses of the server
+// output: an error if a certificate could not be created or written
+func Generate(dir string, hosts []string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	ca := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "racer local CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	ca_key, err := issue(ca, nil, nil, dir, CAFile, CAKeyFile)
+	if err != nil {
+		return err
+	}
+
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "racer server"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	if _, err := issue(server, ca, ca_key, dir, ServerFile, ServerKeyFile); err != nil {
+		return err
+	}
+
+	bot := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "racer bot"},
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	_, err = issue(bot, ca, ca_key, dir, BotFile, BotKeyFile)
+	return err
+}
+
+// func issue: creates a key and a certificate signed by a parent, or self-signed without one, and writes them
+// input: the certificate template, the parent and its key (nil for a self-signed certificate), the directory and the file names
+// output: the new key, or an error if it could not be created or written
+func issue(template *x509.Certificate, parent *x509.Certificate, parent_key *ecdsa.PrivateKey, dir string, cert_file string, key_file string) (*ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	if parent == nil {
+		parent, parent_key = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parent_key)
+	if err != nil {
+		return nil, err
+	}
+	key_der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the keys are only readable by their owner
+	if err := write_pem(filepath.Join(dir, cert_file), "CERTIFICATE", der, 0644); err != nil {
+		return nil, err
+	}
+	if err := write_pem(filepath.Join(dir, key_file), "PRIVATE KEY", key_der, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// func write_pem: writes a PEM block to a file, an existing file gets the mode too
+func write_pem(path string, kind string, der []byte, mode os.FileMode) error {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), mode); err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
+
+// func load_pool: reads the certificates of a PEM file into a pool
+// input: the path of the file
+// output: a pointer to the x509.CertPool object, or an error if the file has no certificate
+func load_pool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(path + " has no PEM certificate")
+	}
+	return pool, nil
+}
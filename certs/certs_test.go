@@ -0,0 +1,168 @@
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// func generate: writes a CA with its server and bot certificates to a temporary directory
+// input: the test
+// output: the directory
+func generate(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := Generate(dir, []string{"localhost", "127.0.0.1"}); err != nil {
+		t.Fatalf("could not generate the certificates: %v", err)
+	}
+	return dir
+}
+
+// func handshake: connects a client to a server over TLS on the loopback interface
+// input: the test and the configurations of the server and the client
+// output: the server end of the connection once its handshake is over (nil if it failed), and
+// the error of the client's handshake
+func handshake(t *testing.T, server *tls.Config, client *tls.Config) (net.Conn, error) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", server)
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		if err := conn.(*tls.Conn).Handshake(); err != nil {
+			conn.Close()
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err != nil {
+		return <-accepted, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	server_conn := <-accepted
+	if server_conn != nil {
+		t.Cleanup(func() { server_conn.Close() })
+	}
+	return server_conn, nil
+}
+
+func TestGenerateKeepsKeysPrivate(t *testing.T) {
+	dir := generate(t)
+
+	for _, name := range []string{CAFile, CAKeyFile, ServerFile, ServerKeyFile, BotFile, BotKeyFile} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("%s was not written: %v", name, err)
+		}
+		if name == CAKeyFile || name == ServerKeyFile || name == BotKeyFile {
+			if mode := info.Mode().Perm(); mode != 0600 {
+				t.Errorf("%s has mode %o, want 600", name, mode)
+			}
+		}
+	}
+}
+
+func TestHandshakeWithPinnedCA(t *testing.T) {
+	dir := generate(t)
+	server, err := Server(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(filepath.Join(dir, CAFile), false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conn, err := handshake(t, server, client); err != nil || conn == nil {
+		t.Fatalf("the handshake failed: %v", err)
+	}
+}
+
+func TestHandshakeFailsWithAnotherCA(t *testing.T) {
+	dir := generate(t)
+	other := generate(t)
+	server, err := Server(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(filepath.Join(other, CAFile), false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := handshake(t, server, client); err == nil {
+		t.Fatal("the client trusted a server certificate signed by another CA")
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := generate(t)
+	server, err := Server(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), filepath.Join(dir, CAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	without, err := Client(filepath.Join(dir, CAFile), false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	with, err := Client(filepath.Join(dir, CAFile), false, filepath.Join(dir, BotFile), filepath.Join(dir, BotKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a bot without a certificate gets through the handshake but is turned away
+	conn, err := handshake(t, server, without)
+	if err != nil || conn == nil {
+		t.Fatalf("the handshake without a client certificate failed: %v", err)
+	}
+	if _, err := CheckPeer(conn, true); !errors.Is(err, ErrNoCertificate) {
+		t.Errorf("a bot without a certificate got %v, want ErrNoCertificate", err)
+	}
+
+	// a racer does not need one
+	if name, err := CheckPeer(conn, false); err != nil || name != "" {
+		t.Errorf("a racer without a certificate got %q, %v", name, err)
+	}
+
+	// a bot with a certificate signed by the client CA is let in under its name
+	conn, err = handshake(t, server, with)
+	if err != nil || conn == nil {
+		t.Fatalf("the handshake with a client certificate failed: %v", err)
+	}
+	if name, err := CheckPeer(conn, true); err != nil || name != "racer bot" {
+		t.Errorf("a bot with a certificate got %q, %v, want %q", name, err, "racer bot")
+	}
+}
+
+func TestClientCertificateFromAnotherCA(t *testing.T) {
+	dir := generate(t)
+	other := generate(t)
+	server, err := Server(filepath.Join(dir, ServerFile), filepath.Join(dir, ServerKeyFile), filepath.Join(dir, CAFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := Client(filepath.Join(dir, CAFile), false, filepath.Join(other, BotFile), filepath.Join(other, BotKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// with TLS 1.3 the client finishes its side first, the server is the one that refuses
+	if conn, _ := handshake(t, server, client); conn != nil {
+		t.Fatal("the server accepted a client certificate signed by another CA")
+	}
+}
@@ -3,18 +3,42 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strings"
+	"time"
+
+	"racer/certs"
+	"racer/protocol"
 )
 
+// reaction time of computer based clients to the start lights going out
+const bot_reaction = 200 * time.Millisecond
+
 var (
 	host  = flag.String("host", "localhost", "server host")
 	port  = flag.String("port", "9000", "server port")
 	human = flag.Bool("human", true, "flag for human based client")
+	role  = flag.String("role", "", "role to join with: racer, spectator or bot, by default racer for humans and bot otherwise")
+	class = flag.String("class", "", "car class to race with: player, steady or wild, empty for the default one")
+	name  = flag.String("name", "", "name to race with, asked for when empty")
+	token = flag.String("token", "", "reconnect token the server gave on an earlier connection, to get the same car back")
+
+	username     = flag.String("username", "", "account to log in to, empty to join without one")
+	password     = flag.String("password", "", "password of the account, asked for when empty")
+	accountToken = flag.String("accountToken", "", "token of the account to log in with instead of a username and password, for bots")
+	register     = flag.Bool("register", false, "create the account with the username and password before logging in")
+
+	useTLS      = flag.Bool("tls", false, "connect over TLS, implied by the other tls flags")
+	tlsCA       = flag.String("tlsCA", "", "CA file the server certificate must be signed by, empty to trust the system's CAs")
+	tlsInsecure = flag.Bool("tlsInsecure", false, "do not check the server certificate, only for trying things out")
+	tlsCert     = flag.String("tlsCert", "", "certificate file the client presents to the server, bots need one on servers that check them")
+	tlsKey      = flag.String("tlsKey", "", "key file of the client certificate")
 )
 
 // client's main function
@@ -31,8 +55,20 @@ func main() {
 		bufio.NewReader(os.Stdin).ReadBytes('\n')
 	} */
 
-	// connect to the server using net package (https://pkg.go.dev/net)
-	conn, err := net.Dial("tcp", server_address)
+	// connect to the server using net package (https://pkg.go.dev/net), or over TLS
+	var conn net.Conn
+	var err error
+	if *useTLS || *tlsCA != "" || *tlsInsecure || *tlsCert != "" {
+		var config *tls.Config
+		config, err = certs.Client(*tlsCA, *tlsInsecure, *tlsCert, *tlsKey)
+		if err != nil {
+			// print an error message and exit
+			log.Fatal(err)
+		}
+		conn, err = tls.Dial("tcp", server_address, config)
+	} else {
+		conn, err = net.Dial("tcp", server_address)
+	}
 	if err != nil {
 		// print an error message and exit
 		log.Fatal(err)
@@ -44,22 +80,69 @@ func main() {
 	// print a welcome message
 	fmt.Println("Welcome to the racing game client!")
 
-	// prompt the user for their name
-	fmt.Print("Enter your name: ")
+	// humans race and programs are bots unless another role is asked for
+	if *role == "" {
+		*role = protocol.RoleRacer
+		if !*human {
+			*role = protocol.RoleBot
+		}
+	}
 
-	// read a line from the standard input as the player name
-	name, err := bufio.NewReader(os.Stdin).ReadString('\n')
-	if err != nil {
+	// the prompts share one reader of the standard input so they do not lose each other's lines
+	stdin := bufio.NewReader(os.Stdin)
+
+	// prompt the user for their name, spectators and players logged in to an account do not need one
+	if *name == "" && *role != protocol.RoleSpectator && *token == "" && *username == "" && *accountToken == "" {
+		fmt.Print("Enter your name: ")
+
+		// read a line from the standard input as the player name
+		line, err := stdin.ReadString('\n')
+		if err != nil {
+			// print an error message and exit
+			log.Fatal(err)
+		}
+		*name = strings.TrimSpace(line)
+	}
+
+	// log in with the account token, or with the username and its password
+	var login *protocol.Login
+	if *accountToken != "" {
+		login = &protocol.Login{Token: *accountToken}
+	} else if *username != "" {
+		if *password == "" {
+			fmt.Print("Enter your password: ")
+
+			// read a line from the standard input as the password
+			line, err := stdin.ReadString('\n')
+			if err != nil {
+				// print an error message and exit
+				log.Fatal(err)
+			}
+			*password = strings.TrimRight(line, "\r\n")
+		}
+		login = &protocol.Login{Username: *username, Password: *password, Register: *register}
+	}
+
+	// say hello to the server
+	hello := protocol.NewHello(*role, *class, *name, []string{protocol.CapabilityText}, *token, login)
+	if err := protocol.Send(conn, hello); err != nil {
 		// print an error message and exit
 		log.Fatal(err)
 	}
 
-	// write the player name to the connection
-	_, err = fmt.Fprintln(conn, name)
+	// wait for the server to let the client in, the same reader keeps reading the race
+	reader := bufio.NewReader(conn)
+	welcome, err := protocol.ReadReply(reader)
 	if err != nil {
-		// print an error message and exit
+		// print the reason and exit
 		log.Fatal(err)
 	}
+	if welcome.Role != protocol.RoleSpectator && !welcome.Resumed {
+		fmt.Printf("If you lose the connection, run the client again with -token %s to get your car back.\n", welcome.Token)
+	}
+	if welcome.AccountToken != "" {
+		fmt.Printf("Your account is ready. Bots can log in to it with -accountToken %s, it is not shown again.\n", welcome.AccountToken)
+	}
 
 	// create a channel to communicate between the main goroutine and the reader goroutine
 	ch := make(chan struct{})
@@ -72,7 +155,7 @@ func main() {
 		// loop until the connection is closed
 		for {
 			// read from the connection
-			n, err := conn.Read(buf)
+			n, err := reader.Read(buf)
 			if err != nil {
 				// check if the error is due to the connection being closed
 				if err == io.EOF {
@@ -91,6 +174,12 @@ func main() {
 
 			// print the message to the console
 			fmt.Print(string(buf[:n]))
+
+			// computer based clients launch on their own when the start lights go out
+			if !*human && strings.Contains(string(buf[:n]), "Lights out") {
+				time.Sleep(bot_reaction)
+				fmt.Fprintln(conn, "go")
+			}
 		}
 
 		// send a signal to the channel that the reader goroutine is done
@@ -100,7 +189,7 @@ func main() {
 	// start a loop to read input from the user and send it to the server
 	for {
 		// read a line from the standard input
-		input, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		input, err := stdin.ReadString('\n')
 		if err != nil {
 			// print an error message and exit the loop
 			log.Println(err)
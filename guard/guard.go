@@ -0,0 +1,304 @@
+// Package guard protects the server from clients that abuse it: a listener that refuses banned
+// addresses and addresses with too many connections open, a ban list kept in a text file, and
+// a token bucket to limit how fast a client sends commands.
+package guard
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// reasons a connection is refused for, passed to the OnRefuse callback
+var (
+	ErrBanned  = errors.New("the address is banned")
+	ErrTooMany = errors.New("the address has too many connections open")
+)
+
+// type BanList: the addresses and networks that cannot connect, saved to a file on every change
+type BanList struct {
+	path     string // empty to keep the list in memory
+	mu       sync.Mutex
+	prefixes []netip.Prefix // single addresses are /32 or /128 prefixes
+}
+
+// func LoadBanList: reads a ban list with an address or a network (like 10.0.0.0/8) on each line,
+// blank lines and lines starting with # are skipped and a file that does not exist yet is an empty list
+// input: the path of the file, empty for a list that is only kept in memory
+// output: a pointer to a BanList object, or an error if the file could not be read or has a bad line
+func LoadBanList(path string) (*BanList, error) {
+	list := &BanList{path: path}
+	if path == "" {
+		return list, nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return list, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prefix, err := parse_entry(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, number, err)
+		}
+		list.prefixes = append(list.prefixes, prefix)
+	}
+	return list, scanner.Err()
+}
+
+// func Banned: tells if an address is banned
+// input: the address
+// output: true if the address is in a banned network
+func (list *BanList) Banned(address netip.Addr) bool {
+	address = address.Unmap()
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	for _, prefix := range list.prefixes {
+		if prefix.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// func Add: bans an address or a network
+// input: the address or the network
+// output: the entry as it is kept, or an error if it is not an address or could not be saved
+func (list *BanList) Add(entry string) (string, error) {
+	prefix, err := parse_entry(entry)
+	if err != nil {
+		return "", err
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	if slices.Contains(list.prefixes, prefix) {
+		return format_entry(prefix), nil
+	}
+	list.prefixes = append(list.prefixes, prefix)
+
+	if err := list.save(); err != nil {
+		list.prefixes = list.prefixes[:len(list.prefixes)-1]
+		return "", err
+	}
+	return format_entry(prefix), nil
+}
+
+// func Remove: lifts the ban on an address or a network, exactly as it was banned
+// input: the address or the network
+// output: an error if it is not banned or the list could not be saved
+func (list *BanList) Remove(entry string) error {
+	prefix, err := parse_entry(entry)
+	if err != nil {
+		return err
+	}
+
+	list.mu.Lock()
+	defer list.mu.Unlock()
+	i := slices.Index(list.prefixes, prefix)
+	if i < 0 {
+		return fmt.Errorf("%s is not banned", format_entry(prefix))
+	}
+	previous := slices.Clone(list.prefixes)
+	list.prefixes = slices.Delete(list.prefixes, i, i+1)
+
+	if err := list.save(); err != nil {
+		list.prefixes = previous
+		return err
+	}
+	return nil
+}
+
+// func Entries: the banned addresses and networks
+// input: none
+// output: the entries in the order they were banned
+func (list *BanList) Entries() []string {
+	list.mu.Lock()
+	defer list.mu.Unlock()
+
+	entries := []string{}
+	for _, prefix := range list.prefixes {
+		entries = append(entries, format_entry(prefix))
+	}
+	return entries
+}
+
+// func save: writes the list to its file (if any), the mutex must be held
+func (list *BanList) save() error {
+	if list.path == "" {
+		return nil
+	}
+
+	lines := []string{"# addresses and networks banned from the server, one on each line"}
+	for _, prefix := range list.prefixes {
+		lines = append(lines, format_entry(prefix))
+	}
+	return os.WriteFile(list.path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// func parse_entry: reads an address or a network of the ban list
+// input: the entry
+// output: the entry as a prefix, or an error if it is neither an address nor a network
+func parse_entry(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not an address or a network", entry)
+		}
+		return prefix.Masked(), nil
+	}
+
+	address, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an address or a network", entry)
+	}
+	address = address.Unmap()
+	return netip.PrefixFrom(address, address.BitLen()), nil
+}
+
+// func format_entry: an entry of the ban list as shown, single addresses without their prefix length
+func format_entry(prefix netip.Prefix) string {
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String()
+	}
+	return prefix.String()
+}
+
+// func Address: the IP address of a connection's remote end
+// input: the remote address of the connection, as host:port
+// output: the IP address, invalid if the connection is not over IP
+func Address(remote string) netip.Addr {
+	port, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return port.Addr().Unmap()
+}
+
+// type Listener: accepts the connections of addresses that are not banned and do not already
+// have too many connections open, the others are closed straight away
+type Listener struct {
+	net.Listener
+	bans     *BanList
+	limit    int                   // most connections open from one address, 0 for no limit
+	OnRefuse func(net.Addr, error) // called with every refused connection, may be nil
+	mu       sync.Mutex
+	open     map[netip.Addr]int // connections open from each address
+}
+
+// func NewListener: wraps a listener to refuse banned addresses and addresses with too many connections
+// input: the listener, the ban list and the most connections open from one address (0 for no limit)
+// output: a pointer to a Listener object
+func NewListener(listener net.Listener, bans *BanList, limit int) *Listener {
+	return &Listener{Listener: listener, bans: bans, limit: limit, open: map[netip.Addr]int{}}
+}
+
+// func Accept: waits for a connection that is let in, closing the refused ones
+// input: none
+// output: the connection, which gives back its slot when closed, or an error if the listener failed
+func (listener *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		address := Address(conn.RemoteAddr().String())
+		if err := listener.admit(address); err != nil {
+			conn.Close()
+			if listener.OnRefuse != nil {
+				listener.OnRefuse(conn.RemoteAddr(), err)
+			}
+			continue
+		}
+		return &tracked_conn{Conn: conn, release: func() { listener.release(address) }}, nil
+	}
+}
+
+// func admit: takes a connection slot of an address that is not banned
+// input: the address
+// output: ErrBanned or ErrTooMany if the connection is refused
+func (listener *Listener) admit(address netip.Addr) error {
+	if listener.bans != nil && listener.bans.Banned(address) {
+		return ErrBanned
+	}
+
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	if listener.limit > 0 && listener.open[address] >= listener.limit {
+		return ErrTooMany
+	}
+	listener.open[address]++
+	return nil
+}
+
+// func release: gives back a connection slot of an address
+func (listener *Listener) release(address netip.Addr) {
+	listener.mu.Lock()
+	defer listener.mu.Unlock()
+	listener.open[address]--
+	if listener.open[address] <= 0 {
+		delete(listener.open, address)
+	}
+}
+
+// type tracked_conn: a connection that gives back its slot the first time it is closed
+type tracked_conn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (conn *tracked_conn) Close() error {
+	conn.once.Do(conn.release)
+	return conn.Conn.Close()
+}
+
+// type Bucket: a token bucket, a client can send a burst of commands and then one every so often
+type Bucket struct {
+	rate   float64 // tokens added each second
+	burst  float64 // most tokens the bucket holds
+	tokens float64
+	last   time.Time
+}
+
+// func NewBucket: creates a full bucket
+// input: the commands allowed each second and the burst allowed on top of them
+// output: a pointer to a Bucket object
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// func Allow: takes a token if there is one, the bucket is used by a single goroutine
+// input: the current time
+// output: true if the command is allowed
+func (bucket *Bucket) Allow(now time.Time) bool {
+	if !bucket.last.IsZero() {
+		bucket.tokens = min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -0,0 +1,299 @@
+// Package metrics keeps counters, gauges and histograms about a running server and
+// serves them over HTTP in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metric types as named in the exposition format
+const (
+	type_counter   = "counter"
+	type_gauge     = "gauge"
+	type_histogram = "histogram"
+)
+
+// type metric: anything the registry can write out
+type metric interface {
+	write(w io.Writer)
+}
+
+// type Registry: the metrics served on the endpoint
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// func NewRegistry: creates a registry with no metrics
+// input: none
+// output: a pointer to a Registry object
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// func Counter: adds a counter, a value that only goes up
+// input: the metric name, its help text and the names of its labels
+// output: a pointer to the Counter object
+func (registry *Registry) Counter(name string, help string, labels ...string) *Counter {
+	counter := &Counter{new_vector(name, help, type_counter, labels)}
+	registry.add(counter.vector)
+	return counter
+}
+
+// func Gauge: adds a gauge, a value that goes up and down
+// input: the metric name, its help text and the names of its labels
+// output: a pointer to the Gauge object
+func (registry *Registry) Gauge(name string, help string, labels ...string) *Gauge {
+	gauge := &Gauge{new_vector(name, help, type_gauge, labels)}
+	registry.add(gauge.vector)
+	return gauge
+}
+
+// func Histogram: adds a histogram, which counts observations in buckets
+// input: the metric name, its help text and the upper bounds of the buckets in increasing order
+// output: a pointer to the Histogram object
+func (registry *Registry) Histogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	registry.add(histogram)
+	return histogram
+}
+
+func (registry *Registry) add(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+// func WriteTo: writes every metric in the text exposition format
+// input: the writer to send the metrics to
+// output: the number of bytes written and an error if they could not be written
+func (registry *Registry) WriteTo(w io.Writer) (int64, error) {
+	registry.mu.Lock()
+	metrics := append([]metric(nil), registry.metrics...)
+	registry.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// func ServeHTTP: answers a scrape with every metric
+// input: the response writer and the request
+// output: none
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.WriteTo(w)
+}
+
+// type Counter: a value that only goes up, one for each set of label values
+type Counter struct {
+	*vector
+}
+
+// func Inc: adds one to the counter
+// input: the label values, in the order the labels were given
+// output: none
+func (counter *Counter) Inc(labels ...string) {
+	counter.Add(1, labels...)
+}
+
+// func Add: adds a positive amount to the counter, negative amounts are ignored
+// input: the amount and the label values, in the order the labels were given
+// output: none
+func (counter *Counter) Add(amount float64, labels ...string) {
+	if amount > 0 {
+		counter.update(labels, func(value float64) float64 { return value + amount })
+	}
+}
+
+// type Gauge: a value that goes up and down, one for each set of label values
+type Gauge struct {
+	*vector
+}
+
+// func Set: sets the gauge
+// input: the value and the label values, in the order the labels were given
+// output: none
+func (gauge *Gauge) Set(value float64, labels ...string) {
+	gauge.update(labels, func(float64) float64 { return value })
+}
+
+// func Add: moves the gauge up, or down with a negative amount
+// input: the amount and the label values, in the order the labels were given
+// output: none
+func (gauge *Gauge) Add(amount float64, labels ...string) {
+	gauge.update(labels, func(value float64) float64 { return value + amount })
+}
+
+// func Reset: forgets every set of label values, for example the series of a race that is over
+// input: none
+// output: none
+func (gauge *Gauge) Reset() {
+	gauge.mu.Lock()
+	defer gauge.mu.Unlock()
+	gauge.samples = map[string]*sample{}
+}
+
+// type vector: the samples of a counter or a gauge, keyed by their label values
+type vector struct {
+	name    string
+	help    string
+	kind    string
+	labels  []string
+	mu      sync.Mutex
+	samples map[string]*sample
+}
+
+// type sample: the value of a metric for a set of label values
+type sample struct {
+	labels []string
+	value  float64
+}
+
+func new_vector(name string, help string, kind string, labels []string) *vector {
+	return &vector{name: name, help: help, kind: kind, labels: labels, samples: map[string]*sample{}}
+}
+
+// func update: changes the value of a sample, creating it at zero if it does not exist
+// input: the label values and the function giving the new value from the old one
+// output: none
+func (v *vector) update(labels []string, change func(float64) float64) {
+	values, key := v.key(labels)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.samples[key]
+	if !ok {
+		s = &sample{labels: values}
+		v.samples[key] = s
+	}
+	s.value = change(s.value)
+}
+
+// func Delete: forgets the sample of a set of label values, for example the series of a client
+// that disconnected, so a long running server does not keep one for every client it ever had
+// input: the label values, in the order the labels were given
+// output: none
+func (v *vector) Delete(labels ...string) {
+	_, key := v.key(labels)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.samples, key)
+}
+
+// func key: the label values of a sample and the key it is kept under, missing label values
+// are empty and extra ones are dropped so the output stays valid
+func (v *vector) key(labels []string) ([]string, string) {
+	values := make([]string, len(v.labels))
+	copy(values, labels)
+	return values, strings.Join(values, "\xff")
+}
+
+// func write: writes the samples sorted by their label values
+func (v *vector) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	// a metric without labels is shown at zero before it is first set
+	if len(v.labels) == 0 && len(v.samples) == 0 {
+		fmt.Fprintf(w, "%s 0\n", v.name)
+		return
+	}
+
+	keys := []string{}
+	for key := range v.samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.samples[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, label_text(v.labels, s.labels), format_value(s.value))
+	}
+}
+
+// type Histogram: counts observations in buckets, with their sum and count
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds of the buckets
+	mu      sync.Mutex
+	counts  []uint64 // observations in each bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+// func Observe: counts an observation in the first bucket it fits in
+// input: the observed value
+// output: none
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	for i, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+			break
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+// func write: writes the cumulative buckets, the sum and the count
+func (histogram *Histogram) write(w io.Writer) {
+	histogram.mu.Lock()
+	defer histogram.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", histogram.name, histogram.help, histogram.name, type_histogram)
+
+	cumulative := uint64(0)
+	for i, bound := range histogram.buckets {
+		cumulative += histogram.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", histogram.name, format_value(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", histogram.name, histogram.count)
+	fmt.Fprintf(w, "%s_sum %s\n", histogram.name, format_value(histogram.sum))
+	fmt.Fprintf(w, "%s_count %d\n", histogram.name, histogram.count)
+}
+
+// func label_text: the labels of a sample as written in the exposition format
+// input: the label names and values
+// output: the labels between braces, empty if there are none
+func label_text(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", name, values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// func format_value: a sample value as written in the exposition format
+func format_value(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,105 @@
+// Package names checks the names players race with and keeps them unique in a race.
+package names
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// shortest and longest names, in characters
+const (
+	MinLength = 2
+	MaxLength = 20
+)
+
+// punctuation allowed in names on top of letters, digits and spaces
+const punctuation = "-_.'"
+
+// words players cannot race with, matched against each word of a name once digits
+// standing for letters are read as those letters
+var blocked = []string{
+	"arse", "ass", "asshole", "bastard", "bitch", "bollocks", "cock", "crap", "cunt", "dick",
+	"fuck", "fucker", "fucking", "motherfucker", "nazi", "piss", "prick", "shit", "slut", "twat",
+	"wanker", "whore",
+}
+
+// digits players use in place of letters
+var leet = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b")
+
+// func Clean: trims a name and turns every run of spaces inside it into a single space
+// input: the name
+// output: the cleaned name
+func Clean(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// func Validate: checks that a cleaned name has an allowed length, only uses allowed
+// characters and is not offensive or reserved
+// input: the name
+// output: an error explaining what is wrong with the name, or nil if it is fine
+func Validate(name string) error {
+	length := utf8.RuneCountInString(name)
+	if length < MinLength || length > MaxLength {
+		return fmt.Errorf("names must be %d to %d characters long", MinLength, MaxLength)
+	}
+
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' ' && !strings.ContainsRune(punctuation, r) {
+			return fmt.Errorf("names can only use letters, digits, spaces and %s", punctuation)
+		}
+	}
+
+	// the CPU racers are named by the server
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > 0 && words[0] == "cpu" {
+		return errors.New("names starting with CPU are kept for the CPU racers")
+	}
+
+	// the words are checked on their own and joined, so spacing a word out does not hide it
+	candidates := append(words, strings.Join(words, ""))
+	for _, word := range candidates {
+		word = leet.Replace(word)
+		for _, bad := range blocked {
+			if word == bad {
+				return errors.New("this name is not allowed")
+			}
+		}
+	}
+
+	return nil
+}
+
+// func Unique: makes a name unique by adding the first free number to it
+// input: the name and a function telling if a name is already taken
+// output: the name if it is free, otherwise the name followed by a number
+func Unique(name string, taken func(string) bool) string {
+	if !taken(name) {
+		return name
+	}
+	return Numbered(name, 2, taken)
+}
+
+// func Numbered: finds the first free name made of a base and a number, like Player 3
+// input: the base, the first number to try and a function telling if a name is already taken
+// output: the free name
+func Numbered(base string, first int, taken func(string) bool) string {
+	for n := first; ; n++ {
+		suffix := fmt.Sprintf(" %d", n)
+
+		// the number is kept whole, the base is cut to keep the name short enough
+		runes := []rune(base)
+		if keep := MaxLength - len(suffix); len(runes) > keep {
+			runes = runes[:max(keep, 0)]
+		}
+
+		name := strings.TrimSpace(string(runes)) + suffix
+		if !taken(name) {
+			return name
+		}
+	}
+}
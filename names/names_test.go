@@ -0,0 +1,91 @@
+package names
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		valid bool
+	}{
+		{"", false},
+		{"a", false},
+		{"ab", true},
+		{"Ana", true},
+		{"Jean-Luc O'Neil", true},
+		{strings.Repeat("a", MaxLength), true},
+		{strings.Repeat("a", MaxLength+1), false},
+		{strings.Repeat("é", MaxLength), true}, // the length is counted in characters, not bytes
+		{strings.Repeat("é", MaxLength+1), false},
+		{"Zoë", true},
+		{"Jose\u0301", false}, // a combining accent is not a letter of its own
+		{"ana\x07", false},
+		{"ana\tbob", false},
+		{"ana\nbob", false},
+		{"\x1b[31mana", false},
+		{"ana\u200bbob", false}, // zero width space
+		{"ana\u202ebob", false}, // right-to-left override
+		{"ana!", false},
+		{"CPU 1", false},
+		{"cpu-fast", false},
+		{"Cupcake", true},
+		{"crap", false},
+		{"Cr4p", false},
+		{"c r a p", false},
+		{"scrappy", true},
+	}
+
+	for _, c := range cases {
+		if err := Validate(c.name); (err == nil) != c.valid {
+			t.Errorf("Validate(%q) = %v, want valid %t", c.name, err, c.valid)
+		}
+	}
+}
+
+// func taken_by: tells if a name is taken by one of the names already in the race, whatever
+// its case, like the server does
+// input: the names in the race
+// output: the function telling if a name is taken
+func taken_by(names ...string) func(string) bool {
+	return func(name string) bool {
+		for _, other := range names {
+			if strings.EqualFold(other, name) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestUnique(t *testing.T) {
+	cases := []struct {
+		name  string
+		taken []string
+		want  string
+	}{
+		{"Ana", nil, "Ana"},
+		{"Ana", []string{"Bob"}, "Ana"},
+		{"Ana", []string{"Ana"}, "Ana 2"},
+		{"ana", []string{"ANA"}, "ana 2"},
+		{"Ana", []string{"Ana", "ana 2"}, "Ana 3"},
+		{"élodie", []string{"ÉLODIE"}, "élodie 2"},
+		{"kim", []string{"\u212aim"}, "kim 2"},           // Kelvin sign
+		{"ΟΔΥΣΣΕΥΣ", []string{"οδυσσευς"}, "ΟΔΥΣΣΕΥΣ 2"}, // final sigma
+		{"Zoë", []string{"Zoe"}, "Zoë"},
+		{"Player", []string{"Player", "Player 2"}, "Player 3"},
+		{strings.Repeat("a", MaxLength), []string{strings.Repeat("a", MaxLength)}, strings.Repeat("a", MaxLength-2) + " 2"},
+		{strings.Repeat("é", MaxLength), []string{strings.Repeat("É", MaxLength)}, strings.Repeat("é", MaxLength-2) + " 2"},
+	}
+
+	for _, c := range cases {
+		got := Unique(c.name, taken_by(c.taken...))
+		if got != c.want {
+			t.Errorf("Unique(%q) with %q taken = %q, want %q", c.name, c.taken, got, c.want)
+		}
+		if err := Validate(got); err != nil {
+			t.Errorf("Unique(%q) with %q taken = %q, which is not a valid name: %v", c.name, c.taken, got, err)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+// Package outbox sends messages to a client from a goroutine of its own, so a slow or stalled
+// client never holds up the race. Messages wait in a queue and are written with a deadline,
+// race boards that are waiting to be sent are replaced by newer ones, and clients that fall
+// too far behind are disconnected.
+package outbox
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// errors returned to the senders and passed to the OnDisconnect callback
+var (
+	ErrClosed  = errors.New("the client is disconnected")
+	ErrLagging = errors.New("the client fell too far behind")
+)
+
+// type Options: the limits of an outbox and the callbacks reporting what happens to it, the
+// callbacks are called from the sender's goroutine or from the writer's so they must be safe to call concurrently
+type Options struct {
+	Limit        int             // most messages waiting to be sent before the client is disconnected
+	Timeout      time.Duration   // longest a single write can take before the client is disconnected
+	OnDrop       func(count int) // called with the number of queued messages that will never be sent, never once Done is closed, may be nil
+	OnDisconnect func(err error) // called once when the client is disconnected for lagging or a failed write, may be nil
+}
+
+// type Outbox: the messages waiting to be sent to a client
+type Outbox struct {
+	conn      net.Conn
+	options   Options
+	mu        sync.Mutex
+	ready     *sync.Cond // signalled when there is something to send or the outbox is closing
+	queue     []string   // messages in the order they were sent
+	board     string     // latest race board, sent after the queued messages
+	has_board bool
+	closing   bool // Close was called, the writer exits once the queue is empty
+	closed    bool // no more messages are accepted
+	done      chan struct{}
+}
+
+// func New: creates an outbox for a connection and starts its writer goroutine
+// input: the connection and the outbox options
+// output: a pointer to an Outbox object
+func New(conn net.Conn, options Options) *Outbox {
+	box := &Outbox{conn: conn, options: options, done: make(chan struct{})}
+	box.ready = sync.NewCond(&box.mu)
+	go box.run()
+	return box
+}
+
+// func Write: queues a message, every write is a message of its own so fmt.Fprint and friends can be used
+// input: the bytes of the message
+// output: the length of the message, or an error if the client is disconnected or too far behind
+func (box *Outbox) Write(p []byte) (int, error) {
+	box.mu.Lock()
+	// the message is refused rather than dropped, the client is gone and its counts with it
+	if box.closed {
+		box.mu.Unlock()
+		return 0, ErrClosed
+	}
+
+	// a client that lets its queue fill up will not catch up, give up on it
+	if len(box.queue) >= box.options.Limit {
+		box.dropped(box.shut() + 1) // before the writer sees the outbox is closed and exits
+		box.mu.Unlock()
+		box.conn.Close() // wakes up the writer if it is stuck in a write
+		box.disconnected(ErrLagging)
+		return 0, ErrLagging
+	}
+
+	box.queue = append(box.queue, string(p))
+	box.ready.Signal()
+	box.mu.Unlock()
+	return len(p), nil
+}
+
+// func Board: queues a race board, replacing the one still waiting to be sent (if any)
+// input: the race board
+// output: none
+func (box *Outbox) Board(board string) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	if box.closed {
+		return
+	}
+
+	// an older board is stale once a newer one exists, it is reported before the writer can
+	// fail and exit so the report never comes after Done
+	if box.has_board {
+		box.dropped(1)
+	}
+	box.board = board
+	box.has_board = true
+	box.ready.Signal()
+}
+
+// func Close: stops accepting messages, the writer sends the ones already queued and closes the connection
+// input: none
+// output: none
+func (box *Outbox) Close() {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	box.closed = true
+	box.closing = true
+	box.ready.Signal()
+}
+
+// func Done: tells when the writer has exited and the connection is closed
+// input: none
+// output: a channel closed once the writer has exited
+func (box *Outbox) Done() <-chan struct{} {
+	return box.done
+}
+
+// func run: writes the queued messages until the outbox is closed or a write fails
+// input: none
+// output: none
+func (box *Outbox) run() {
+	defer close(box.done)
+	defer box.conn.Close()
+
+	for {
+		messages, last := box.take()
+		for i, message := range messages {
+			box.conn.SetWriteDeadline(time.Now().Add(box.options.Timeout))
+			if _, err := io.WriteString(box.conn, message); err != nil {
+				box.mu.Lock()
+				already := box.closed && !box.closing
+				lost := box.shut() + len(messages) - i
+				box.mu.Unlock()
+
+				box.dropped(lost)
+				// a lagging client has already been reported
+				if !already {
+					box.disconnected(err)
+				}
+				return
+			}
+		}
+		if last {
+			return
+		}
+	}
+}
+
+// func take: waits for messages to send and takes all of them, the latest board goes last
+// input: none
+// output: the messages, and true if the outbox is closing and nothing else will be sent
+func (box *Outbox) take() ([]string, bool) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	for len(box.queue) == 0 && !box.has_board && !box.closing && !box.closed {
+		box.ready.Wait()
+	}
+
+	messages := box.queue
+	box.queue = nil
+	if box.has_board {
+		messages = append(messages, box.board)
+		box.board = ""
+		box.has_board = false
+	}
+	return messages, box.closed
+}
+
+// func shut: stops accepting messages and forgets the queued ones, the mutex must be held
+// input: none
+// output: the number of messages that were forgotten
+func (box *Outbox) shut() int {
+	lost := len(box.queue)
+	if box.has_board {
+		lost++
+	}
+	box.queue = nil
+	box.board = ""
+	box.has_board = false
+	box.closed = true
+	box.ready.Signal()
+	return lost
+}
+
+// func dropped: reports messages that will never be sent
+func (box *Outbox) dropped(count int) {
+	if count > 0 && box.options.OnDrop != nil {
+		box.options.OnDrop(count)
+	}
+}
+
+// func disconnected: reports that the client was disconnected
+func (box *Outbox) disconnected(err error) {
+	if box.options.OnDisconnect != nil {
+		box.options.OnDisconnect(err)
+	}
+}
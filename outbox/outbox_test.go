@@ -0,0 +1,70 @@
+package outbox
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"racer/metrics"
+)
+
+// the series of a disconnected client is removed once and stays removed while the race keeps
+// broadcasting to its closed outbox, like the server does with the clients that left
+func TestNoDropsReportedOnceDone(t *testing.T) {
+	registry := metrics.NewRegistry()
+	dropped := registry.Counter("dropped_messages_total", "Messages never sent.", "client")
+
+	server, client := net.Pipe()
+	box := New(server, Options{
+		Limit:   8,
+		Timeout: time.Second,
+		OnDrop: func(count int) {
+			dropped.Add(float64(count), "c1")
+		},
+	})
+	cleaned := make(chan struct{})
+	go func() {
+		<-box.Done()
+		dropped.Delete("c1")
+		close(cleaned)
+	}()
+
+	// nobody reads the pipe, the writer is stuck on the first message and the second board
+	// replaces the first one
+	box.Write([]byte("hello\n"))
+	box.Board("board 1\n")
+	box.Board("board 2\n")
+	if text := exposition(t, registry); !strings.Contains(text, `client="c1"`) {
+		t.Fatalf("no series for the stale board:\n%s", text)
+	}
+
+	// the client disconnects, then the race goes on broadcasting to everyone
+	client.Close()
+	select {
+	case <-cleaned:
+	case <-time.After(time.Second):
+		t.Fatal("the writer did not exit once the client disconnected")
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := box.Write([]byte("lap\n")); err != ErrClosed {
+			t.Errorf("writing to a disconnected client returned %v, want %v", err, ErrClosed)
+		}
+		box.Board("board\n")
+	}
+
+	if text := exposition(t, registry); strings.Contains(text, `client="c1"`) {
+		t.Errorf("the series of the disconnected client came back:\n%s", text)
+	}
+}
+
+// func exposition: the metrics of a registry in the Prometheus text format
+// input: the test and the registry
+// output: the text
+func exposition(t *testing.T, registry *metrics.Registry) string {
+	var text strings.Builder
+	if _, err := registry.WriteTo(&text); err != nil {
+		t.Fatal(err)
+	}
+	return text.String()
+}
@@ -0,0 +1,201 @@
+// Package protocol describes the handshake between a client and the server. The client opens
+// the connection with a hello message and the server answers with a welcome or a rejection,
+// each message is a line of JSON. Once the client is welcomed the server sends the race as text
+// and the client sends its commands as lines of text.
+package protocol
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// version of the protocol spoken by this server and client
+const Version = 1
+
+// message types
+const (
+	TypeHello   = "hello"
+	TypeWelcome = "welcome"
+	TypeReject  = "reject"
+)
+
+// roles a client can join with
+const (
+	RoleRacer     = "racer"     // a person driving a car
+	RoleSpectator = "spectator" // follows the race without a car
+	RoleBot       = "bot"       // a program driving a car
+)
+
+// capabilities a client can ask for, the server answers with the ones it accepted
+const (
+	CapabilityText        = "text"        // the race as plain text
+	CapabilityJSON        = "json"        // the race as JSON messages
+	CapabilityColour      = "colour"      // ANSI colours in the text
+	CapabilityCompression = "compression" // compressed messages
+)
+
+// capabilities the server supports
+var supported = []string{CapabilityText}
+
+// longest hello a server reads, so a client cannot make it buffer an endless line
+const max_hello = 4096
+
+// ErrLineTooLong is returned by ReadLine for a line longer than its limit
+var ErrLineTooLong = errors.New("the line is too long")
+
+// type Hello: the first message of a client
+type Hello struct {
+	Type         string   `json:"type"`
+	Version      int      `json:"version"`
+	Role         string   `json:"role"`
+	Class        string   `json:"class,omitempty"` // car class wanted, empty for the default one
+	Name         string   `json:"name"`            // name the player would like to race with
+	Capabilities []string `json:"capabilities,omitempty"`
+	Token        string   `json:"token,omitempty"` // reconnect token of an earlier welcome, to get the same car back
+	Login        *Login   `json:"login,omitempty"` // account to log in to, nil to join without one
+}
+
+// type Login: the account a client logs in to, with its password or with a token of the account
+type Login struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Token    string `json:"token,omitempty"`    // account token, used instead of the username and password
+	Register bool   `json:"register,omitempty"` // create the account with the username and password first
+}
+
+// type Welcome: the server's answer to a hello it accepted
+type Welcome struct {
+	Type         string   `json:"type"`
+	Version      int      `json:"version"`
+	Client       string   `json:"client"` // id the server gave the client
+	Role         string   `json:"role"`
+	Class        string   `json:"class,omitempty"`
+	Name         string   `json:"name,omitempty"`          // name the racer got, it can differ from the one asked for
+	Capabilities []string `json:"capabilities"`            // capabilities the server accepted
+	Token        string   `json:"token"`                   // token to send in the hello to reconnect
+	Resumed      bool     `json:"resumed"`                 // the token was recognised and the client got its car back
+	Account      string   `json:"account,omitempty"`       // username of the account the client logged in to
+	AccountToken string   `json:"account_token,omitempty"` // token of an account just registered, it is not shown again
+}
+
+// type Reject: the server's answer to a hello it refused, the connection is closed after it
+type Reject struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// func NewHello: creates a hello of the current protocol version
+// input: the role, the car class, the name, the capabilities, the reconnect token and the login (if any)
+// output: a Hello object
+func NewHello(role string, class string, name string, capabilities []string, token string, login *Login) Hello {
+	return Hello{TypeHello, Version, role, class, name, capabilities, token, login}
+}
+
+// func ReadHello: reads the hello a client opens its connection with
+// input: the reader of the connection
+// output: the Hello object, or an error explaining why it is not a valid hello
+func ReadHello(reader *bufio.Reader) (Hello, error) {
+	line, err := ReadLine(reader, max_hello)
+	if errors.Is(err, ErrLineTooLong) {
+		return Hello{}, errors.New("the hello is too long")
+	}
+	if err != nil {
+		return Hello{}, err
+	}
+
+	hello := Hello{}
+	if err := json.Unmarshal([]byte(line), &hello); err != nil || hello.Type != TypeHello {
+		return Hello{}, errors.New("expected a hello message")
+	}
+	if hello.Version != Version {
+		return Hello{}, fmt.Errorf("protocol version %d is not supported, the server speaks version %d", hello.Version, Version)
+	}
+	if hello.Role != RoleRacer && hello.Role != RoleSpectator && hello.Role != RoleBot {
+		return Hello{}, fmt.Errorf("unknown role %q, use %s, %s or %s", hello.Role, RoleRacer, RoleSpectator, RoleBot)
+	}
+	return hello, nil
+}
+
+// func Accepted: the capabilities of a hello the server supports, text is always accepted
+// input: the capabilities asked for
+// output: the accepted capabilities
+func Accepted(capabilities []string) []string {
+	accepted := []string{CapabilityText}
+	for _, capability := range capabilities {
+		if capability != CapabilityText && slices.Contains(supported, capability) && !slices.Contains(accepted, capability) {
+			accepted = append(accepted, capability)
+		}
+	}
+	return accepted
+}
+
+// func ReadReply: reads the server's answer to a hello
+// input: the reader of the connection
+// output: the Welcome object, or an error with the reason if the server rejected the hello
+func ReadReply(reader *bufio.Reader) (Welcome, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return Welcome{}, err
+	}
+
+	var reply struct {
+		Welcome
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal([]byte(line), &reply); err != nil {
+		return Welcome{}, fmt.Errorf("unexpected answer from the server: %s", strings.TrimSpace(line))
+	}
+	switch reply.Type {
+	case TypeWelcome:
+		return reply.Welcome, nil
+	case TypeReject:
+		return Welcome{}, fmt.Errorf("the server refused to let you in: %s", reply.Reason)
+	}
+	return Welcome{}, fmt.Errorf("unexpected %q message from the server", reply.Type)
+}
+
+// func Send: writes a message as a line of JSON
+// input: the writer of the connection and the message
+// output: an error if the message could not be written
+func Send(w io.Writer, message any) error {
+	line, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// func ReadLine: reads a line that is not longer than a limit, the rest of a longer line is
+// skipped without being kept so the next read starts on the next line
+// input: the reader and the limit in bytes
+// output: the line without its newline, or an error if it could not be read or ErrLineTooLong
+func ReadLine(reader *bufio.Reader, limit int) (string, error) {
+	line := []byte{}
+	too_long := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !too_long {
+			line = append(line, chunk...)
+			if len(line) > limit {
+				too_long = true
+				line = nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if too_long {
+			return "", ErrLineTooLong
+		}
+		return strings.TrimSpace(string(line)), nil
+	}
+}
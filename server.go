@@ -3,67 +3,180 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math"
+	"log/slog"
 	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode"
+
+	"racer/accounts"
+	"racer/certs"
+	"racer/guard"
+	"racer/metrics"
+	"racer/names"
+	"racer/outbox"
+	"racer/protocol"
+	"racer/sim"
+	"racer/telemetry"
 
 	"github.com/google/uuid"
 )
 
-// type Racer
-type Racer struct {
-	status      string
-	name        string
-	speed       float64
-	max_speed   float64
-	position    int
-	lane        int
-	current_lap int
-}
-
-// type Race
-type Race struct {
-	race_start_timer int
-	current_lap      int
-	lap_distance     int
-	max_laps         int
-	status           string
-	lanes            []int
-	racers           []Racer
-	top_three        []Racer
-}
-
 // type Server
 type Server struct {
-	clients     []Client
-	race        Race
-	address     string
-	max_players int
+	clients          []Client
+	race             *sim.Race
+	address          string
+	max_players      int
+	race_start_timer int
+	console          chan string          // commands typed by the race director on the server's stdin
+	inputs           chan client_input    // lines sent by the players
+	controls         map[string]sim.Input // controls of the racers their players drive themselves, keyed by racer id
+	race_number      int                  // number of races started since the server started
+	telemetry        telemetry.Writer     // per-tick record of every racer, nil when disabled
+	telemetry_file   *os.File
+	log              *slog.Logger      // structured log of what happens on the server
+	accounts         *accounts.Store   // the players' accounts, nil when they are turned off
+	bans             *guard.BanList    // addresses that cannot connect
+	board            io.Writer         // console output of the race board and messages, discarded with -quiet
+	accepted         chan net.Conn     // connections accepted by the listener
+	joins            chan join_request // clients that said hello, they join the lobby or the race
 }
 
 // type Client
 type Client struct {
-	conn    net.Conn // the connection to the client
-	racer   Racer
-	address string
-	id      string
+	conn         *outbox.Outbox // the messages waiting to be sent to the client, every write is a message
+	racer        sim.Racer      // the client's racer, it has the client's id, spectators have none
+	address      string
+	id           string
+	role         string   // racer, spectator or bot
+	capabilities []string // capabilities of the client the server accepted
+	token        string   // secret the client sends back to reconnect to its racer
+	account      string   // username of the account the client logged in to, empty if it did not
+	took_over    string   // name of the CPU racer whose car the player took over, empty if it did not
+}
+
+// type join_request: a client that said hello and logged in, waiting to join the server
+type join_request struct {
+	conn          net.Conn
+	reader        *bufio.Reader // reader of the connection, it keeps reading the player's lines
+	hello         protocol.Hello
+	account       *accounts.Account // nil if the client did not log in
+	account_token string            // token of an account just registered
+	certificate   string            // name on the client certificate, empty if there is none
 }
 
+// type client_input: a line sent by a player during the game
+type client_input struct {
+	client_id string
+	racer     string // id of the client's racer, empty for spectators
+	line      string
+	left      *outbox.Outbox // set to the outbox of the connection when it closed, the line is then empty
+}
+
+const (
+	light_interval = time.Second             // time between two start lights coming on
+	lights_hold    = 3 * time.Second         // longest random time all five lights stay on
+	launch_window  = 1500 * time.Millisecond // time players have to launch once the lights go out
+	max_grid       = 20                      // most cars the host can put on the grid
+)
+
+// authentication modes
+const (
+	auth_required = "required" // every client logs in to an account
+	auth_optional = "optional" // clients can log in to an account or join without one
+	auth_off      = "off"      // there are no accounts, logins are ignored
+)
+
+var (
+	host            = flag.String("host", "localhost", "server host")
+	port            = flag.String("port", "9000", "server port")
+	numRacers       = flag.Int("numRacers", 4, "number of racers")
+	waitTime        = flag.Int("waitTime", 60, "longest the lobby waits before the race starts, in seconds, whoever is ready, 0 to wait for the players")
+	countdown       = flag.Int("countdown", 5, "seconds counted down before the race starts once every player is ready or the host starts it")
+	lapNumber       = flag.Int("lapNumber", 10, "number of race laps")
+	sectors         = flag.Int("sectors", 3, "number of timed sectors each lap is split into")
+	seed            = flag.Int64("seed", time.Now().UnixNano(), "seed of the race's random number generator")
+	tickRate        = flag.Int("tickRate", 20, "simulation steps per second of race time")
+	boardRate       = flag.Int("boardRate", 1, "race board updates sent per second")
+	timeScale       = flag.Float64("timeScale", 1, "race time speed, 2 is fast-forward and 0.5 is slow-motion")
+	incidents       = flag.Float64("incidentChance", 0.005, "chance of an incident bringing out the safety car on each second of racing")
+	crashes         = flag.Float64("collisionChance", 0.3, "chance of two cars overlapping on the same lane touching on each second of racing")
+	slipstream      = flag.Float64("slipstream", 20, "distance behind another car on the same lane within which a car gets a slipstream, in meters, 0 disables it")
+	weather         = flag.String("weather", "dry", "weather at the start of the race: dry, damp or wet")
+	rain            = flag.Bool("weatherChanges", true, "let the weather change during the race")
+	segments        = flag.Int("weatherSegments", 4, "number of segments of the lap that get wet and dry on their own")
+	telemetryPath   = flag.String("telemetry", "", "file to write every racer's state on every simulation step to, empty disables it")
+	telemetryFormat = flag.String("telemetryFormat", telemetry.FormatCSV, "format of the telemetry file: csv or columnar")
+	metricsAddress  = flag.String("metrics", "", "address to serve the Prometheus metrics on at /metrics (e.g. localhost:9100), empty disables it")
+	logLevel        = flag.String("logLevel", "info", "lowest level of the log records written to stderr: debug, info, warn or error")
+	logFormat       = flag.String("logFormat", "text", "format of the log records: text or json")
+	quiet           = flag.Bool("quiet", false, "do not print the race board and the race messages on the console")
+	sendQueue       = flag.Int("sendQueue", 256, "most messages waiting to be sent to a client before it is disconnected for falling behind")
+	writeTimeout    = flag.Duration("writeTimeout", 5*time.Second, "longest a write to a client can take before it is disconnected")
+	lateEntry       = flag.Duration("lateEntry", 60*time.Second, "race time during which players joining late get a car of their own that starts from the pit lane, after it they take over a CPU car")
+	auth            = flag.String("auth", auth_optional, "player accounts: required, optional or off")
+	accountsPath    = flag.String("accounts", "accounts.json", "file the player accounts are kept in")
+	tlsCert         = flag.String("tlsCert", "", "certificate file of the server, with -tlsKey the players connect over TLS")
+	tlsKey          = flag.String("tlsKey", "", "key file of the server certificate")
+	tlsClientCA     = flag.String("tlsClientCA", "", "CA file client certificates are checked against, bots must present one signed by it")
+	handshakeTime   = flag.Duration("handshakeTimeout", 10*time.Second, "longest a client can take to connect and send its hello")
+	maxConnections  = flag.Int("maxConnections", 8, "most connections open from one address, 0 for no limit")
+	maxLine         = flag.Int("maxLine", 256, "longest line a player can send, in bytes, longer lines are ignored")
+	inputRate       = flag.Float64("inputRate", 5, "commands a player can send each second once its burst is used")
+	inputBurst      = flag.Int("inputBurst", 10, "commands a player can send at once")
+	banList         = flag.String("banList", "", "file of banned addresses and networks, one on each line, empty to keep the bans until the server stops")
+)
+
+// metrics served on the metrics endpoint
 var (
-	host      = flag.String("host", "localhost", "server host")
-	port      = flag.String("port", "9000", "server port")
-	numRacers = flag.Int("numRacers", 4, "number of racers")
-	waitTime  = flag.Int("waitTime", 10, "wait time for the race to start")
-	lapNumber = flag.Int("lapNumber", 10, "number of race laps")
+	registry          = metrics.NewRegistry()
+	connected_clients = registry.Gauge("racer_connected_clients", "Players connected to the server.")
+	active_races      = registry.Gauge("racer_active_races", "Races being run by the server.")
+	races_started     = registry.Counter("racer_races_started_total", "Races started, restarts included.")
+	races_completed   = registry.Counter("racer_races_completed_total", "Races run until every racer was classified.")
+	tick_duration     = registry.Histogram("racer_tick_duration_seconds", "Wall time taken by a simulation step, sending its events included.",
+		[]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1})
+	broadcast_latency = registry.Histogram("racer_broadcast_latency_seconds", "Wall time taken to queue the race board for every client.",
+		[]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 1})
+	client_sent_bytes = registry.Counter("racer_client_sent_bytes_total", "Bytes sent to each client.", "client", "racer")
+	dropped_messages  = registry.Counter("racer_dropped_messages_total", "Messages that were never sent to a client, stale race boards included.", "client", "racer")
+	leader_speed      = registry.Gauge("racer_leader_speed_meters_per_second", "Speed of the race leader.", "race")
+	leader_lap        = registry.Gauge("racer_leader_lap", "Lap the race leader is on.", "race")
+	refused_conns     = registry.Counter("racer_refused_connections_total", "Connections closed before their hello, by reason.", "reason")
+	limited_inputs    = registry.Counter("racer_limited_inputs_total", "Lines players sent too fast or too long, which were ignored.", "client", "racer")
+	lobby_messages    = registry.Counter("racer_lobby_messages_total", "Chat messages the players sent in the lobby.")
 )
 
+// type metered_conn: a client connection that counts the bytes sent through it
+type metered_conn struct {
+	net.Conn
+	client string // id of the client
+	racer  string // name of the client's racer
+}
+
+// func Write: sends bytes to the client
+// input: the bytes
+// output: the number of bytes sent and an error if they could not be sent
+func (conn metered_conn) Write(p []byte) (int, error) {
+	n, err := conn.Conn.Write(p)
+	client_sent_bytes.Add(float64(n), conn.client, conn.racer)
+	return n, err
+}
+
 // func start_server
 func start_server() Server {
 	flag.Parse()
@@ -72,46 +185,148 @@ func start_server() Server {
 	server := Server{}
 	server.address = *host + ":" + *port
 
+	// the log records go to stderr so they do not mix with the race board on stdout
+	logger, err := new_logger(os.Stderr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server.log = logger
+	server.board = os.Stdout
+	if *quiet {
+		server.board = io.Discard
+	}
+
 	// set the server's max_clients to a fixed value (e.g. 10)
 	server.max_players = *numRacers
 
-	// initialize a race with random number of laps between 20 and 40 and status not_started
-	race := Race{}
-	race.current_lap = 1
-	race.max_laps = *lapNumber // rand.Intn(n) returns a random number between [0,n)
-	race.status = "not_started"
+	// create the channel the players' lines are sent through
+	server.inputs = make(chan client_input)
+	server.joins = make(chan join_request)
 
 	// set the race_start_timer to a fixed value (e.g. 10 seconds)
-	race.race_start_timer = *waitTime
+	server.race_start_timer = *waitTime
 
-	// set the lap_distance to a fixed value (e.g. 1000 meters)
-	race.lap_distance = 500
+	if *tickRate < 1 || *boardRate < 1 || *timeScale <= 0 {
+		fatal(server.log, "tickRate and boardRate must be at least 1 and timeScale must be positive")
+	}
+	if *slipstream < 0 {
+		fatal(server.log, "slipstream cannot be negative")
+	}
+	if *sectors < 1 {
+		fatal(server.log, "sectors must be at least 1")
+	}
+	if *sendQueue < 1 || *writeTimeout <= 0 {
+		fatal(server.log, "sendQueue must be at least 1 and writeTimeout must be positive")
+	}
+	if *auth != auth_required && *auth != auth_optional && *auth != auth_off {
+		fatal(server.log, "auth must be required, optional or off")
+	}
+	if *handshakeTime <= 0 || *maxConnections < 0 || *maxLine < 1 || *inputRate <= 0 || *inputBurst < 1 {
+		fatal(server.log, "handshakeTimeout, maxLine, inputRate and inputBurst must be positive and maxConnections cannot be negative")
+	}
+	if (*tlsCert == "") != (*tlsKey == "") || (*tlsClientCA != "" && *tlsCert == "") {
+		fatal(server.log, "tlsCert and tlsKey go together and tlsClientCA needs them")
+	}
+	if *weather != sim.WeatherDry && *weather != sim.WeatherDamp && *weather != sim.WeatherWet {
+		fatal(server.log, "weather must be dry, damp or wet")
+	}
 
-	// set the lanes to a list of numbers from [1, 6]
-	race.lanes = make([]int, 6)
-	for i := range race.lanes {
-		race.lanes[i] = i + 1
+	// initialize a race with the configured number of laps and status not_started
+	cfg := sim.DefaultConfig()
+	cfg.Laps = *lapNumber
+	cfg.Seed = *seed
+	cfg.Sectors = *sectors
+	cfg.IncidentChance = *incidents
+	cfg.CollisionChance = *crashes
+	cfg.SlipstreamDistance = *slipstream
+	cfg.Weather = *weather
+	cfg.WeatherChanges = *rain
+	cfg.WeatherSegments = *segments
+	server.race = sim.NewRace(cfg)
+
+	// everything the flags point at is opened before the players join, so a bad path, file or
+	// address stops the server straight away instead of in the middle of a race
+
+	// the telemetry file
+	if *telemetryPath != "" {
+		file, err := os.Create(*telemetryPath)
+		if err != nil {
+			fatal(server.log, "could not create the telemetry file", "error", err)
+		}
+		writer, err := telemetry.NewWriter(*telemetryFormat, file)
+		if err != nil {
+			fatal(server.log, "could not start the telemetry", "error", err)
+		}
+		server.telemetry = writer
+		server.telemetry_file = file
 	}
 
-	// set the server's race to the initialized race
-	server.race = race
+	// the player accounts
+	if *auth != auth_off {
+		store, err := accounts.Open(*accountsPath)
+		if err != nil {
+			fatal(server.log, "could not load the accounts", "error", err)
+		}
+		server.accounts = store
+	}
 
-	// wait for max_clients to connect or race_start_timer to expire
-	// use a channel to communicate between the main goroutine and the listener goroutine
-	// use a sync.WaitGroup to wait for all clients to be handled
-	// use a mutex to protect the shared server state
-	var wg sync.WaitGroup
-	var mu sync.Mutex
+	// the ban list
+	server.bans, err = guard.LoadBanList(*banList)
+	if err != nil {
+		fatal(server.log, "could not load the ban list", "error", err)
+	}
+
+	// the TLS certificates
+	var tls_config *tls.Config
+	if *tlsCert != "" {
+		tls_config, err = certs.Server(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fatal(server.log, "could not set up TLS", "error", err)
+		}
+	}
+
+	// the metrics endpoint
+	if *metricsAddress != "" {
+		listener, err := net.Listen("tcp", *metricsAddress)
+		if err != nil {
+			fatal(server.log, "could not serve the metrics", "error", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", registry)
+		go http.Serve(listener, mux)
+		server.log.Info("metrics served", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+	}
+
+	// the listener goroutine sends the accepted connections to a channel, they are greeted by
+	// goroutines of their own and the clients that said hello join the lobby, and later the race
 	ch := make(chan net.Conn)
+	server.accepted = ch
 
 	// start a listener goroutine that accepts incoming connections and sends them to the channel
-	fmt.Printf("Server started at %s\n", server.address)
+	server.log.Info("server started", "address", server.address, "tls", tls_config != nil, "client_certificates", *tlsClientCA != "")
 
 	go func() {
 		listener, err := net.Listen("tcp", server.address)
 
 		if err != nil {
-			log.Fatal(err)
+			fatal(server.log, "could not listen for players", "error", err)
+		}
+
+		// banned addresses and addresses with too many connections open are turned away before anything is read
+		guarded := guard.NewListener(listener, server.bans, *maxConnections)
+		guarded.OnRefuse = func(address net.Addr, err error) {
+			reason := "banned"
+			if errors.Is(err, guard.ErrTooMany) {
+				reason = "too_many"
+			}
+			refused_conns.Inc(reason)
+			server.log.Warn("connection refused", "address", address.String(), "reason", err)
+		}
+		listener = guarded
+
+		// the connections accepted are TLS connections, their handshake happens on the first read
+		if tls_config != nil {
+			listener = tls.NewListener(listener, tls_config)
 		}
 
 		defer listener.Close()
@@ -119,474 +334,1690 @@ func start_server() Server {
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
-				log.Println(err)
+				server.log.Error("could not accept a connection", "error", err)
 				continue
 			}
 			ch <- conn // send the connection to the channel
 		}
 	}()
 
-	// start a timer goroutine that sends a signal to the channel after race_start_timer seconds
-	go func() {
-		time.Sleep(time.Duration(race.race_start_timer) * time.Second)
-		ch <- nil // send a nil value to the channel to indicate timeout
-	}()
+	go accept_joins(server)
+
+	// let the players get ready until the race starts
+	run_lobby(&server)
+
+	// fill the remaining slots in the race with CPU racers
+	for len(server.race.Snapshot().Racers) < server.max_players {
+		var cpuName = next_cpu_name(server)
+		server.log.Info("CPU racer added", "racer", cpuName)
+
+		// use a simple naming scheme for CPU racers
+		server.race.AddRacer(cpuName, true)
+	}
+
+	// return the server object
+	return server
+}
+
+// func start
+func start() {
+	// start reading the operator's commands before the server blocks waiting for players
+	console := start_console()
+
+	// start the server and get the race object
+	server := start_server()
+	server.console = console
+
+	// start the race
+	start_race(&server)
 
-	// loop until max_clients are connected or timeout occurs
-	fmt.Printf("Waiting %ds before starting the race! 🚦\n", race.race_start_timer)
-	for len(server.clients) < server.max_players {
-		conn := <-ch // receive a value from the channel
-		if conn == nil {
-			// timeout occurred, break the loop
+	for {
+		// run the race until it is completed or aborted
+		run_race(&server)
+
+		// display the podium racers
+		display_podium(server)
+
+		// let the operator restart the race or end the game
+		if !wait_for_restart(&server) {
 			break
 		}
+	}
+
+	// end the game and close the server
+	end_game(server)
+}
+
+// func greet_client: runs the start of a connection, the TLS handshake (if any), the hello and the login
+// input: a pointer to a Server object and the connection
+// output: the join_request object, and false if the client was turned away (its connection is closed)
+func greet_client(server *Server, c net.Conn) (join_request, bool) {
+	// a client that never says hello would hold up the start of the race
+	c.SetDeadline(time.Now().Add(*handshakeTime))
+
+	// a client that fails the TLS handshake cannot be sent a rejection
+	if tls_conn, ok := c.(*tls.Conn); ok {
+		if err := tls_conn.Handshake(); err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				refused_conns.Inc("handshake_timeout")
+			}
+			server.log.Warn("TLS handshake failed", "address", c.RemoteAddr().String(), "error", err)
+			c.Close()
+			return join_request{}, false
+		}
+	}
+
+	// the player opens the connection with a hello, the same reader keeps
+	// reading the player's lines once it has joined
+	reader := bufio.NewReader(c)
+	hello, err := protocol.ReadHello(reader)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		refused_conns.Inc("handshake_timeout")
+		reject_client(server, c, fmt.Sprintf("no hello was received within %s", *handshakeTime))
+		return join_request{}, false
+	}
+	if err != nil {
+		reject_client(server, c, err.Error())
+		return join_request{}, false
+	}
+	c.SetDeadline(time.Time{})
 
-		// increment the wait group counter
-		wg.Add(1)
+	// bots are trusted workers, they prove it with a certificate signed by the client CA
+	certificate, err := certs.CheckPeer(c, *tlsClientCA != "" && hello.Role == protocol.RoleBot)
+	if err != nil {
+		reject_client(server, c, "bots must present a client certificate signed by the server's CA")
+		return join_request{}, false
+	}
 
-		// handle the connection in a separate goroutine
+	// log the player in before it joins, checking a password takes a while
+	account, account_token, err := authenticate(server, hello)
+	if err != nil {
+		reject_client(server, c, err.Error())
+		return join_request{}, false
+	}
 
-		go func(c net.Conn, race *Race) {
-			defer wg.Done()
+	return join_request{c, reader, hello, account, account_token, certificate}, true
+}
 
-			// read a line from the connection as the player name
-			name, err := bufio.NewReader(conn).ReadString('\n')
-			if err != nil {
-				// print an error message and return
-				log.Println(err)
-				name = fmt.Sprintf("Player %d", rand.Intn(20)+1)
+// func welcome_client: sends the welcome to a client that joined and starts reading its lines
+// input: a pointer to a Server object, the join_request object, the Client object and true if it got its racer back
+// output: none
+func welcome_client(server *Server, request join_request, client Client, resumed bool) {
+	connected_clients.Add(1)
+
+	// log that a player has joined
+	client_log(server, client).Info("player joined", "address", client.address, "role", client.role, "account", client.account,
+		"certificate", request.certificate, "class", client.racer.Profile, "capabilities", strings.Join(client.capabilities, ","),
+		"resumed", resumed, "took_over", client.took_over)
+
+	// send the welcome to the client, followed by a message for the person reading it
+	protocol.Send(client.conn, protocol.Welcome{
+		Type:         protocol.TypeWelcome,
+		Version:      protocol.Version,
+		Client:       client.id,
+		Role:         client.role,
+		Class:        client.racer.Profile,
+		Name:         client.racer.Name,
+		Capabilities: client.capabilities,
+		Token:        client.token,
+		Resumed:      resumed,
+		Account:      client.account,
+		AccountToken: request.account_token,
+	})
+	switch {
+	case client.role == protocol.RoleSpectator && request.hello.Role != protocol.RoleSpectator:
+		fmt.Fprintln(client.conn, "The race is full and there is no CPU car left to take over, you are spectating. 👀")
+	case client.role == protocol.RoleSpectator:
+		fmt.Fprintln(client.conn, "Welcome to the race! You are spectating. 👀")
+	case resumed:
+		fmt.Fprintf(client.conn, "Welcome back, %s! You are in lane %d.\n", client.racer.Name, client.racer.Lane)
+	case client.took_over != "" && server.race.Snapshot().Status != sim.RaceOngoing:
+		fmt.Fprintf(client.conn, "Welcome, %s! You take over the %s car of %s for the next race.\n",
+			client.racer.Name, client.racer.Profile, client.took_over)
+	case client.took_over != "":
+		fmt.Fprintf(client.conn, "Welcome to the race, %s! You take over the %s car of %s on lap %d, in lane %d.\n",
+			client.racer.Name, client.racer.Profile, client.took_over, client.racer.CurrentLap, client.racer.Lane)
+	case client.racer.InPit:
+		fmt.Fprintf(client.conn, "Welcome to the race, %s! Your %s car has a top speed of %.2f m/s and starts from the pit lane.\n",
+			client.racer.Name, client.racer.Profile, client.racer.MaxSpeed)
+	default:
+		fmt.Fprintf(client.conn, "Welcome to the race, %s! Your %s car has a top speed of %.2f m/s and your lane is %d.\n",
+			client.racer.Name, client.racer.Profile, client.racer.MaxSpeed, client.racer.Lane)
+	}
+	if request.account != nil {
+		fmt.Fprintf(client.conn, "Logged in as %s: %s\n", request.account.Username, career_display(request.account.Stats))
+	}
+
+	// forward the player's lines to the race
+	go read_client_input(server.inputs, client, request.reader, client_log(server, client))
+}
+
+// func accept_joins: greets the clients that connect and hands the ones that said hello to the
+// lobby, or to the race once it has started, which lets them join between two steps
+// input: a Server object
+// output: none
+func accept_joins(server Server) {
+	for c := range server.accepted {
+		go func(c net.Conn) {
+			if request, ok := greet_client(&server, c); ok {
+				server.joins <- request
 			}
+		}(c)
+	}
+}
+
+// type lobby_state: the players getting ready for the race
+type lobby_state struct {
+	ready     map[string]bool // players ready to race, by client id
+	host      string          // id of the client that can change the settings and start the race, empty if there is none
+	countdown int             // seconds left before the race starts, 0 when it is not counting down
+	ticker    *time.Ticker    // ticks every second of the countdown
+	closed    bool            // the countdown is over, the race starts
+}
 
-			if len(name) <= 1 {
-				name = fmt.Sprintf("Player %d", rand.Intn(20)+1)
+// func run_lobby: lets the players join and get ready, the race starts after a countdown once every
+// player is ready or the host starts it, or straight away when the lobby runs out of time
+// input: a pointer to a Server object
+// output: none (modifies the Server object in place)
+func run_lobby(server *Server) {
+	lobby := lobby_state{ready: map[string]bool{}, ticker: time.NewTicker(time.Second)}
+	defer lobby.ticker.Stop()
+
+	// the lobby runs out of time after race_start_timer seconds, it waits for the players with 0
+	var timeout <-chan time.Time
+	if server.race_start_timer > 0 {
+		timeout = time.After(time.Duration(server.race_start_timer) * time.Second)
+	}
+	server.log.Info("lobby open", "seconds", server.race_start_timer, "grid", server.max_players)
+
+	for !lobby.closed {
+		select {
+		case request := <-server.joins:
+			join_lobby(server, &lobby, request)
+		case input := <-server.inputs:
+			handle_lobby_command(server, &lobby, input)
+		case <-lobby.ticker.C:
+			if lobby.countdown == 0 {
+				continue
+			}
+			lobby.countdown--
+			if lobby.countdown == 0 {
+				close_lobby(server, &lobby)
+				continue
 			}
+			send_to_all(server, fmt.Sprintf("The race starts in %d... ⏱️", lobby.countdown))
+		case <-timeout:
+			send_to_all(server, "The lobby ran out of time. ⌛")
+			close_lobby(server, &lobby)
+		}
+	}
+}
 
-			// trim the newline character from the name
-			name = strings.TrimSpace(name)
+// func join_lobby: lets a client join the lobby and tells everyone
+// input: a pointer to a Server object, a pointer to the lobby_state object and the join_request object
+// output: none (modifies the Server and lobby_state objects in place)
+func join_lobby(server *Server, lobby *lobby_state, request join_request) {
+	client, resumed, err := join_client(server, request.conn, request.hello, request.account)
+	if err != nil {
+		reject_client(server, request.conn, err.Error())
+		return
+	}
+	welcome_client(server, request, client, resumed)
 
-			// Prints that a player has joined
-			fmt.Printf("%s just joined!\n", name)
+	if client.role == protocol.RoleSpectator {
+		fmt.Fprintln(client.conn, lobby_display(server, lobby))
+		return
+	}
 
-			// create a new client with a unique id and a random racer
-			client := Client{}
-			client.address = c.RemoteAddr().String()
-			client.id = uuid.New().String() // use github.com/google/uuid package to generate unique ids
+	// bots do not wait for anyone, and the first player to join hosts the race
+	if client.role == protocol.RoleBot {
+		lobby.ready[client.id] = true
+	}
+	if lobby.host == "" && client.role == protocol.RoleRacer {
+		lobby.host = client.id
+	}
+	if !resumed {
+		send_to_all(server, fmt.Sprintf("%s joins the lobby. 👋", client.racer.Name))
+	}
 
-			racer := Racer{}
-			racer.name = name                        // use the client provided name
-			racer.speed = 0                          // all cars start with a speed of 0 m/s
-			racer.max_speed = rand.Float64()*10 + 55 // random speed between [55, 65) meters per second
-			racer.position = 0                       // initial position is zero
-			racer.current_lap = 1                    // initial lap is 1
+	// the race does not start with a player that has not got ready yet
+	if !lobby.ready[client.id] {
+		cancel_countdown(server, lobby, fmt.Sprintf("%s is not ready", client.racer.Name))
+	}
+	update_lobby(server, lobby)
+}
 
-			// assign a random lane to the racer from the available lanes
-			lane_index := rand.Intn(len(race.lanes))
-			racer.lane = race.lanes[lane_index]
+// func handle_lobby_command: runs a command a player typed in the lobby, lines that are not commands are chat
+// input: a pointer to a Server object, a pointer to the lobby_state object and the player's input
+// output: none (modifies the Server and lobby_state objects in place)
+func handle_lobby_command(server *Server, lobby *lobby_state, input client_input) {
+	client := find_client(input.client_id, *server)
+	if client == nil || client.conn == nil {
+		return
+	}
 
-			// remove the assigned lane from the available lanes
-			// race.lanes = append(race.lanes[:lane_index], race.lanes[lane_index+1:]...)
+	// a connection the player replaced by coming back does not take it out of the lobby
+	if input.left != nil {
+		if input.left == client.conn {
+			leave_lobby(server, lobby, *client)
+		}
+		return
+	}
 
-			// set the racer status to waiting
-			racer.status = "waiting"
+	fields := strings.Fields(input.line)
+	if len(fields) == 0 {
+		return
+	}
 
-			// assign the racer to the client
-			client.racer = racer
+	client_log(server, *client).Debug("lobby command", "command", input.line)
+
+	racer := client.role != protocol.RoleSpectator
+	is_host := client.id == lobby.host
+	switch strings.ToLower(fields[0]) {
+	case "ready":
+		if !racer {
+			fmt.Fprintln(client.conn, "Spectators do not race, there is nothing to get ready for.")
+			return
+		}
+		if lobby.ready[client.id] {
+			return
+		}
+		lobby.ready[client.id] = true
+		send_to_all(server, fmt.Sprintf("%s is ready. ✅", client.racer.Name))
+		update_lobby(server, lobby)
 
-			// assign the connection to the client
-			client.conn = conn
+	case "unready":
+		if !racer || !lobby.ready[client.id] {
+			return
+		}
+		delete(lobby.ready, client.id)
+		cancel_countdown(server, lobby, fmt.Sprintf("%s is not ready", client.racer.Name))
+		send_to_all(server, fmt.Sprintf("%s is not ready. ⏳", client.racer.Name))
+		update_lobby(server, lobby)
+
+	case "say":
+		lobby_chat(server, *client, strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(input.line), fields[0])))
+
+	case "start", "laps", "grid":
+		if !is_host {
+			fmt.Fprintln(client.conn, "Only the host can change the settings and start the race. 👑")
+			return
+		}
+		handle_host_command(server, lobby, *client, fields)
 
-			// lock the mutex before modifying the server state
-			mu.Lock()
+	default:
+		lobby_chat(server, *client, input.line)
+	}
+}
 
-			// add the client to the server's client list
-			server.clients = append(server.clients, client)
+// func handle_host_command: runs a command only the host can type, changing a setting makes everyone get ready again
+// input: a pointer to a Server object, a pointer to the lobby_state object, the host's Client object and the command's fields
+// output: none (modifies the Server and lobby_state objects in place)
+func handle_host_command(server *Server, lobby *lobby_state, host Client, fields []string) {
+	value := 0
+	if len(fields) == 2 {
+		value, _ = strconv.Atoi(fields[1])
+	}
 
-			// add the racer to the race's racer list
-			server.race.racers = append(server.race.racers, racer)
+	switch strings.ToLower(fields[0]) {
+	case "start":
+		if lobby.countdown > 0 {
+			return
+		}
+		send_to_all(server, fmt.Sprintf("%s starts the race. 👑", host.racer.Name))
+		start_countdown(server, lobby)
+		return
+
+	case "laps":
+		if err := server.race.SetLaps(value); err != nil {
+			fmt.Fprintf(host.conn, "Could not change the number of laps: %v\n", err)
+			return
+		}
+		send_to_all(server, fmt.Sprintf("%s sets the race to %d laps. 🔁", host.racer.Name, value))
 
-			// unlock the mutex after modifying the server state
-			mu.Unlock()
+	case "grid":
+		joined := len(server.race.Snapshot().Racers)
+		if value < max(joined, 1) || value > max_grid {
+			fmt.Fprintf(host.conn, "The grid must have between %d and %d cars.\n", max(joined, 1), max_grid)
+			return
+		}
+		server.max_players = value
+		send_to_all(server, fmt.Sprintf("%s sets the grid size to %d, CPU racers fill the empty places. 🏎️", host.racer.Name, value))
+	}
 
-			// send a welcome message to the client
-			fmt.Fprintf(c, "Welcome to the race, %s! Your speed is %.2f m/s and your lane is %d.\n", name, racer.speed, racer.lane)
+	// the players agree to the new settings again, bots take whatever they get
+	for id := range lobby.ready {
+		if client := find_client(id, *server); client == nil || client.role != protocol.RoleBot {
+			delete(lobby.ready, id)
+		}
+	}
+	cancel_countdown(server, lobby, "the settings changed")
+	update_lobby(server, lobby)
+}
 
-		}(conn, &race) // pass the connection as an argument to the goroutine
+// func leave_lobby: takes a player that disconnected out of the lobby, a new host is picked if it was the host
+// input: a pointer to a Server object, a pointer to the lobby_state object and the Client object
+// output: none (modifies the Server and lobby_state objects in place)
+func leave_lobby(server *Server, lobby *lobby_state, client Client) {
+	events := []sim.Event{}
+	if client.role != protocol.RoleSpectator {
+		events, _ = server.race.RemoveRacer(client.racer.ID)
 	}
+	server.clients = slices.DeleteFunc(server.clients, func(other Client) bool { return other.id == client.id })
+	send_events(server, events)
+	delete(lobby.ready, client.id)
+	client_log(server, client).Info("player left the lobby")
 
-	// wait for all connection handler goroutines to finish
-	wg.Wait()
+	if client.role == protocol.RoleSpectator {
+		return
+	}
+	send_to_all(server, fmt.Sprintf("%s leaves the lobby. 👋", client.racer.Name))
+
+	// the player that joined first after the host hosts the race
+	if lobby.host == client.id {
+		lobby.host = ""
+		for _, other := range server.clients {
+			if other.role == protocol.RoleRacer {
+				lobby.host = other.id
+				send_to_all(server, fmt.Sprintf("%s is the new host. 👑", other.racer.Name))
+				break
+			}
+		}
+	}
+	update_lobby(server, lobby)
+}
 
-	// fill the remaining slots in the race with CPU racers
-	for len(server.race.racers) < server.max_players {
-		var cpuName = fmt.Sprintf("CPU %d", len(server.race.racers)+1)
-		fmt.Println(cpuName + " was added to the race 💻")
+// func update_lobby: sends the lobby to everyone and starts the countdown once every player is ready
+// input: a pointer to a Server object and a pointer to the lobby_state object
+// output: none (modifies the lobby_state object in place)
+func update_lobby(server *Server, lobby *lobby_state) {
+	send_to_all(server, lobby_display(server, lobby))
 
-		racer := Racer{}
-		racer.name = cpuName                     // use a simple naming scheme for CPU racers
-		racer.speed = 0                          // all cars start with a speed of 0 m/s
-		racer.max_speed = rand.Float64()*10 + 50 // random speed between [50, 60) meters per second
-		racer.position = 0                       // initial position is zero
-		racer.current_lap = 1                    // initial lap is 1
+	if lobby.countdown > 0 {
+		return
+	}
+	racers := 0
+	for _, client := range server.clients {
+		if client.role == protocol.RoleSpectator {
+			continue
+		}
+		if !lobby.ready[client.id] {
+			return
+		}
+		racers++
+	}
+	if racers > 0 {
+		send_to_all(server, "Everyone is ready! 🚦")
+		start_countdown(server, lobby)
+	}
+}
 
-		// assign a random lane to the racer from the available lanes
-		lane_index := rand.Intn(len(race.lanes))
-		racer.lane = race.lanes[lane_index]
+// func start_countdown: starts counting down to the race, the race starts straight away with a countdown of 0
+// input: a pointer to a Server object and a pointer to the lobby_state object
+// output: none (modifies the lobby_state object in place)
+func start_countdown(server *Server, lobby *lobby_state) {
+	if *countdown == 0 {
+		close_lobby(server, lobby)
+		return
+	}
 
-		// remove the assigned lane from the available lanes
-		// race.lanes = append(race.lanes[:lane_index], race.lanes[lane_index+1:]...)
+	// the next tick is a full second away
+	lobby.countdown = *countdown
+	lobby.ticker.Reset(time.Second)
+	send_to_all(server, fmt.Sprintf("The race starts in %d... ⏱️", lobby.countdown))
+}
 
-		// set the racer status to waiting
-		racer.status = "waiting"
+// func close_lobby: ends the lobby, the players go to the grid
+// input: a pointer to a Server object and a pointer to the lobby_state object
+// output: none (modifies the lobby_state object in place)
+func close_lobby(server *Server, lobby *lobby_state) {
+	lobby.closed = true
+	lobby.countdown = 0
+	send_to_all(server, "The lobby is closed, to the grid! 🏁")
+	server.log.Info("lobby closed", "racers", len(server.race.Snapshot().Racers), "grid", server.max_players)
+}
 
-		// add the racer to the race's racer list
-		server.race.racers = append(server.race.racers, racer)
+// func cancel_countdown: stops counting down to the race, if it is counting down
+// input: a pointer to a Server object, a pointer to the lobby_state object and the reason
+// output: none (modifies the lobby_state object in place)
+func cancel_countdown(server *Server, lobby *lobby_state, reason string) {
+	if lobby.countdown == 0 {
+		return
 	}
+	lobby.countdown = 0
+	send_to_all(server, fmt.Sprintf("The countdown is cancelled, %s. ✋", reason))
+}
 
-	// return the server object
-	return server
+// func lobby_chat: sends a player's message to everyone in the lobby, without the characters that could mess with their terminals
+// input: a pointer to a Server object, the player's Client object and the message
+// output: none
+func lobby_chat(server *Server, client Client, message string) {
+	message = strings.Map(func(r rune) rune {
+		if unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, message)
+	if strings.TrimSpace(message) == "" {
+		return
+	}
+
+	name := client.racer.Name
+	if client.role == protocol.RoleSpectator {
+		name = "👀 spectator"
+	}
+	lobby_messages.Inc()
+	send_to_all(server, fmt.Sprintf("💬 %s: %s", name, message))
 }
 
-// func start
-func start() {
-	// start the server and get the race object
-	server := start_server()
+// func lobby_display: the lobby as shown to the players, who hosts, who is ready and the race settings
+// input: a pointer to a Server object and a pointer to the lobby_state object
+// output: the lobby, one line for each player
+func lobby_display(server *Server, lobby *lobby_state) string {
+	race := server.race.Snapshot()
+	lines := []string{fmt.Sprintf("🏁 Lobby: %d/%d cars on the grid, %d laps, CPU racers fill the empty cars", len(race.Racers), server.max_players, race.MaxLaps)}
 
-	// start the race
-	start_race(&server)
+	spectators := 0
+	for _, client := range server.clients {
+		if client.role == protocol.RoleSpectator {
+			spectators++
+			continue
+		}
+		host := "  "
+		if client.id == lobby.host {
+			host = "👑"
+		}
+		ready := "⏳ not ready"
+		if lobby.ready[client.id] {
+			ready = "✅ ready"
+		}
+		bot := ""
+		if client.role == protocol.RoleBot {
+			bot = " 🤖"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s%s (%s) %s", host, client.racer.Name, bot, client.racer.Profile, ready))
+	}
+	if spectators > 0 {
+		lines = append(lines, fmt.Sprintf("👀 %d spectating", spectators))
+	}
+	if lobby.countdown > 0 {
+		lines = append(lines, "The race is counting down, type unready to stop it.")
+	}
+	lines = append(lines, "Commands: ready, unready, say <message>. Host: start, laps <n>, grid <n>.")
+	return strings.Join(lines, "\n")
+}
+
+// func join_late: lets a client join once the lobby is over, between two steps of the race
+// input: a pointer to a Server object and the join_request object
+// output: none (modifies the Server object in place)
+func join_late(server *Server, request join_request) {
+	client, resumed, err := join_client(server, request.conn, request.hello, request.account)
+	if err != nil {
+		reject_client(server, request.conn, err.Error())
+		return
+	}
+	welcome_client(server, request, client, resumed)
+
+	// the others hear about the new racer
+	switch {
+	case client.took_over != "":
+		send_to_all(server, fmt.Sprintf("%s takes over the car of %s. 🔄", client.racer.Name, client.took_over))
+	case client.role != protocol.RoleSpectator && !resumed:
+		send_to_all(server, fmt.Sprintf("%s joins the race from the pit lane. 🅿️", client.racer.Name))
+	}
+}
+
+// func enter_late: finds a car for a player joining a race that has started, within the late-entry
+// window it gets a car of its own that starts from the pit lane, taking the place of the CPU racer
+// furthest back if the race is full, after it it takes over the car of the CPU racer furthest back
+// input: a pointer to a Server object, the id and name of the player's racer and the car Profile it asked for
+// output: the player's Racer object, the name of the CPU racer it took the car of (empty if it got its
+// own), and false if there is no car left for it
+func enter_late(server *Server, id string, name string, profile sim.Profile) (sim.Racer, string, bool) {
+	race := server.race.Snapshot()
+	cpu, has_cpu := last_cpu_racer(race)
+
+	if race.Status == sim.RaceOngoing && race.Elapsed < lateEntry.Seconds() {
+		if len(race.Racers) >= server.max_players {
+			if !has_cpu {
+				return sim.Racer{}, "", false
+			}
+			events, _ := server.race.RemoveRacer(cpu.ID)
+			race_log(server).Info("CPU racer withdrawn", "racer", cpu.Name, "for", name)
+			send_to_all(server, fmt.Sprintf("%s is withdrawn to make room for %s. 💻", cpu.Name, name))
+			send_events(server, events)
+		}
+		racer, err := server.race.AddRacerInPit(id, name, profile, false)
+		return racer, "", err == nil
+	}
+
+	if !has_cpu {
+		return sim.Racer{}, "", false
+	}
+	racer, err := server.race.TakeOver(cpu.ID, id, name)
+	return racer, cpu.Name, err == nil
+}
+
+// func last_cpu_racer: finds the CPU racer furthest back that is still racing, or any CPU racer once the race is over
+// input: a snapshot of the race
+// output: a copy of the Racer object, and false if there is none
+func last_cpu_racer(race sim.Snapshot) (sim.Racer, bool) {
+	racers := map[string]sim.Racer{}
+	for _, racer := range race.Racers {
+		racers[racer.ID] = racer
+	}
+
+	for i := len(race.Standings) - 1; i >= 0; i-- {
+		racer := racers[race.Standings[i].ID]
+		if racer.CPU && (racer.Status == sim.StatusRunning || race.Status != sim.RaceOngoing) {
+			return racer, true
+		}
+	}
+	return sim.Racer{}, false
+}
+
+// func authenticate: logs a client in to the account of its hello, registering it first if asked to
+// input: a pointer to a Server object and the hello
+// output: a pointer to the Account object (nil if the client joins without one), the token of an
+// account just registered, or an error explaining why the client cannot log in
+func authenticate(server *Server, hello protocol.Hello) (*accounts.Account, string, error) {
+	login := hello.Login
+	if server.accounts == nil {
+		return nil, "", nil
+	}
+	if login == nil {
+		if *auth == auth_required {
+			return nil, "", errors.New("this server needs an account, log in or register")
+		}
+		return nil, "", nil
+	}
+
+	// bots log in with a token of their account
+	if login.Token != "" {
+		account, err := server.accounts.LoginToken(login.Token)
+		return &account, "", err
+	}
+
+	if !login.Register {
+		account, err := server.accounts.Login(login.Username, login.Password)
+		return &account, "", err
+	}
+
+	// the usernames follow the rules of the racer names
+	username := names.Clean(login.Username)
+	if err := names.Validate(username); err != nil {
+		return nil, "", err
+	}
+	account, err := server.accounts.Register(username, login.Password)
+	if err != nil {
+		return nil, "", err
+	}
+	token, err := server.accounts.IssueToken(username)
+	if err != nil {
+		return nil, "", err
+	}
+	server.log.Info("account registered", "account", username)
+	return &account, token, nil
+}
+
+// func join_client: lets a client that sent a valid hello join the server, a client that sends
+// the token of a client already in the race, or logs in to its account, gets its racer back on
+// the new connection
+// input: a pointer to a Server object (only the goroutine running the lobby or the race calls it, so
+// the clients and the race are never changed at the same time), the connection, the hello and the
+// account the client logged in to (nil if it did not)
+// output: the Client object, true if it got its racer back, or an error explaining why it cannot join
+func join_client(server *Server, c net.Conn, hello protocol.Hello, account *accounts.Account) (Client, bool, error) {
+	for i, client := range server.clients {
+		if (hello.Token != "" && client.token == hello.Token) || (account != nil && client.id == account.ID()) {
+			// the old connection is replaced by the new one
+			client.conn.Close()
+			client.conn = new_outbox(server, c, client.id, client.racer.Name)
+			client.address = c.RemoteAddr().String()
+			server.clients[i] = client
+			return client, true, nil
+		}
+	}
+
+	client := Client{}
+	client.address = c.RemoteAddr().String()
+	client.id = uuid.New().String() // use github.com/google/uuid package to generate unique ids
+	client.token = uuid.New().String()
+	client.role = hello.Role
+	client.capabilities = protocol.Accepted(hello.Capabilities)
+
+	// a player logged in to an account keeps the same id from a connection to the next
+	if account != nil {
+		client.id = account.ID()
+		client.account = account.Username
+	}
+
+	if client.role != protocol.RoleSpectator {
+		profile, ok := sim.PlayerClass(hello.Class)
+		if !ok {
+			return Client{}, false, fmt.Errorf("unknown car class %q", hello.Class)
+		}
+
+		// players without a name get their username or the first free Player N, a name already in
+		// use, or the username of somebody else's account, gets a number
+		taken := func(name string) bool {
+			owned := account != nil && strings.EqualFold(name, account.Username)
+			return name_taken(*server, name) || (!owned && server.accounts != nil && server.accounts.Exists(name))
+		}
+		name := names.Clean(hello.Name)
+		if name == "" && account != nil {
+			name = account.Username
+		}
+		if name == "" {
+			name = names.Numbered("Player", 1, taken)
+		} else if err := names.Validate(name); err != nil {
+			return Client{}, false, err
+		}
+		name = names.Unique(name, taken)
 
+		if server.race.Snapshot().Status == sim.RaceNotStarted {
+			if len(server.race.Snapshot().Racers) >= server.max_players {
+				return Client{}, false, errors.New("the race is full, join as a spectator")
+			}
+
+			// add a racer with random stats to the race and assign it to the client, the
+			// racer has the client's id
+			client.racer = server.race.AddRacerWithID(client.id, name, profile, false)
+		} else if racer, took_over, ok := enter_late(server, client.id, name, profile); ok {
+			client.racer = racer
+			client.took_over = took_over
+		} else {
+			// there is no car left, the player follows the race instead
+			client.role = protocol.RoleSpectator
+		}
+	}
+
+	// the messages to the client are sent by a goroutine of its own
+	client.conn = new_outbox(server, c, client.id, client.racer.Name)
+
+	// add the client to the server's client list
+	server.clients = append(server.clients, client)
+
+	return client, false, nil
+}
+
+// func new_outbox: creates the outbox the messages to a client are sent through, counting what is sent
+// input: a pointer to a Server object, the connection, the client's id and its racer's name
+// output: a pointer to an outbox.Outbox object
+func new_outbox(server *Server, c net.Conn, id string, name string) *outbox.Outbox {
+	logger := server.log.With("client", id, "racer", name)
+	box := outbox.New(metered_conn{c, id, name}, outbox.Options{
+		Limit:   *sendQueue,
+		Timeout: *writeTimeout,
+		OnDrop: func(count int) {
+			dropped_messages.Add(float64(count), id, name)
+		},
+		OnDisconnect: func(err error) {
+			logger.Warn("player disconnected for falling behind", "error", err)
+		},
+	})
+
+	// the client's series go away with its connection so they do not pile up over a long session
+	go func() {
+		<-box.Done()
+		client_sent_bytes.Delete(id, name)
+		dropped_messages.Delete(id, name)
+	}()
+	return box
+}
+
+// func reject_client: refuses a client that cannot join, telling it why, and closes its connection
+// input: a pointer to a Server object, the connection and the reason
+// output: none
+func reject_client(server *Server, c net.Conn, reason string) {
+	server.log.Warn("player rejected", "address", c.RemoteAddr().String(), "reason", reason)
+
+	c.SetWriteDeadline(time.Now().Add(*writeTimeout))
+	protocol.Send(c, protocol.Reject{Type: protocol.TypeReject, Reason: reason})
+	c.Close()
+}
+
+// func run_race: steps and displays the race until it is over, handling the operator's commands
+// input: a pointer to a Server object with a started race
+// output: none (modifies the Server object in place)
+func run_race(server *Server) {
 	// use a wait group to synchronize the main goroutine and the display/update goroutine
 	var wg sync.WaitGroup
 
 	// increment the wait group counter
 	wg.Add(1)
 
-	// start a display/update gorout
-	// goroutine that runs while the race is ongoing
+	// the race moves by a fixed step of race time on every tick, the time scale only
+	// changes how often the ticks happen so it never changes the race outcome
+	tick := time.Second / time.Duration(*tickRate)
+	sim_ticker := time.NewTicker(time.Duration(float64(tick) / *timeScale))
+	board_ticker := time.NewTicker(time.Second / time.Duration(*boardRate))
+
+	// start a display/update goroutine that runs while the race is ongoing
 	go func() {
 		defer wg.Done()
-
-		// loop until the race status is complete
-		for server.race.status != "complete" {
-
-			// display the race status
-			display_race_status(&server)
-
-			// update the race state in-place
-			update_race_status(&server)
-
-			// sleep for a fixed interval (e.g. 1 second) to simulate time passing
-			time.Sleep(time.Second)
+		defer sim_ticker.Stop()
+		defer board_ticker.Stop()
+
+		// display the race status before the first step
+		display_race_status(server)
+
+		// loop until the race is complete or aborted
+		for !server.race.Over() {
+			select {
+			case <-sim_ticker.C:
+				// update the race state in-place, it does not move while it is paused
+				update_race_status(server, tick)
+			case <-board_ticker.C:
+				// display the race status
+				display_race_status(server)
+			case input := <-server.inputs:
+				// run the command a player typed
+				handle_racer_command(server, input)
+			case request := <-server.joins:
+				// let a player join the race in progress
+				join_late(server, request)
+			case line, ok := <-server.console:
+				if !ok {
+					// the console was closed, stop listening to it
+					server.console = nil
+					continue
+				}
+				handle_command(server, line)
+			}
 		}
 	}()
 
 	// wait for the display/update goroutine to finish
 	wg.Wait()
 
-	// display the podium racers
-	display_podium(server)
+	active_races.Set(0)
+	if server.race.Complete() {
+		races_completed.Inc()
+		record_results(server)
+	}
 
-	// end the game and close the server
-	end_game(server)
+	race := server.race.Snapshot()
+	winner := ""
+	if len(race.TopThree) > 0 {
+		winner = race.TopThree[0].Name
+	}
+	race_log(server).Info("race over", "status", race.Status, "winner", winner, "elapsed", race.Elapsed)
 }
 
-// func start_race
-func start_race(server *Server) {
-
-	// set the race status to ongoing
-	server.race.status = "ongoing"
+// func record_results: adds the result of every player logged in to an account to its career
+// input: a pointer to a Server object with a complete race
+// output: none (tells each player its career)
+func record_results(server *Server) {
+	if server.accounts == nil {
+		return
+	}
 
-	// set the current lap to 1
-	server.race.current_lap = 1
+	for _, racer := range server.race.Snapshot().Results {
+		client := find_client_by_racer(racer.ID, *server)
+		if client == nil || client.account == "" {
+			continue
+		}
 
-	// set the racer status to running for all racers
-	for i := range server.race.racers {
-		server.race.racers[i].status = "running"
+		result := accounts.Result{Place: racer.Place, Finished: racer.Status == sim.StatusFinished, BestLap: racer.BestLap()}
+		stats, err := server.accounts.Record(client.account, result)
+		if err != nil {
+			client_log(server, *client).Error("could not record the result", "error", err)
+			continue
+		}
+		fmt.Fprintf(client.conn, "Your career: %s 🏆\n", career_display(stats))
 	}
+}
 
-	// send a message to all clients that the race has started
-	for _, client := range server.clients {
-		if client.conn != nil {
-			fmt.Fprintf(client.conn, "The race has started! Good luck!\n")
-		}
+// func career_display: the results of an account as shown to its player
+// input: the account's Stats object
+// output: the races, wins, podiums, championship points and best lap
+func career_display(stats accounts.Stats) string {
+	text := fmt.Sprintf("%d races, %d wins, %d podiums, %d championship points", stats.Races, stats.Wins, stats.Podiums, stats.Points)
+	if stats.BestLap > 0 {
+		text += fmt.Sprintf(", best lap %.3fs", stats.BestLap)
 	}
+	return text + "."
 }
 
-// func display_race_status
-func display_race_status(server *Server) {
-	// get the race object from the server
+// func start_race: runs the start procedure, five lights come on one after the other and
+// go out after a random time, the players launch by typing go as soon as they go out
+// input: a pointer to a Server object
+// output: none (modifies the Server object in place)
+func start_race(server *Server) {
+	server.race_number++
+	races_started.Inc()
+	active_races.Set(1)
 
-	// create a buffer to store the formatted output
-	var buf bytes.Buffer
+	// only the race being run has leader gauges
+	leader_speed.Reset()
+	leader_lap.Reset()
 
-	// write the race status to the buffer
-	fmt.Fprintf(&buf, "\nRace 🏁 status: %s\n", server.race.status)
-	fmt.Fprintf(&buf, "Latest Lap: %d/%d\n", server.race.current_lap, server.race.max_laps)
+	// forget whatever the players typed before the start procedure, every car starts driven by the CPU
+	drain_client_input(server)
+	server.controls = map[string]sim.Input{}
 
-	// loop through the racers and write their info to the buffer
-	for _, racer := range server.race.racers {
-		// draw the racer with a lane number, a car emoji, and a progress bar
-		fmt.Fprintf(&buf, "%d 🏎️ [%s>%s]", racer.lane, strings.Repeat("=", racer.position/10), strings.Repeat(" ", (server.race.lap_distance-racer.position)/10))
+	send_to_all(server, "Drivers, take your positions! Type go and press ENTER as soon as the lights go out. 🚦")
 
-		lap_display := fmt.Sprintf("Lap: %d/%d", racer.current_lap, server.race.max_laps)
+	// the players that launch before the lights go out jump the start
+	jump_starts := map[string]bool{}
+	on_launch := func(input client_input) {
+		jump_starts[input.racer] = true // keyed by racer id
+	}
 
-		if racer.current_lap > server.race.max_laps {
-			lap_display = "Finished! 🏁"
+	// light up the five lights one per second, then hold them for a random time
+	for lights := 1; lights <= 5; lights++ {
+		send_to_all(server, strings.Repeat("🔴", lights)+strings.Repeat("⚫", 5-lights))
+		wait_for_launches(server, time.Now().Add(light_interval), on_launch)
+	}
+	wait_for_launches(server, time.Now().Add(time.Duration(rand.Int63n(int64(lights_hold)))), on_launch)
+
+	send_to_all(server, "⚫⚫⚫⚫⚫ Lights out and away we go!")
+	lights_out := time.Now()
+
+	// measure the reaction time of the players that launch after the lights go out
+	reactions := map[string]time.Duration{}
+	for id := range jump_starts {
+		reactions[id] = 0
+	}
+	wait_for_launches(server, lights_out.Add(launch_window), func(input client_input) {
+		if _, launched := reactions[input.racer]; !launched {
+			reactions[input.racer] = time.Since(lights_out)
 		}
+	})
 
-		// write the racer's name, speed, and position to the buffer
-		fmt.Fprintf(&buf, "%s - %s (%.2f m/s) %d/%dm\n", lap_display, racer.name, racer.speed, racer.position, server.race.lap_distance)
+	// the players that did not launch get away slowly
+	for _, client := range server.clients {
+		if client.role == protocol.RoleSpectator {
+			continue
+		}
+		if _, launched := reactions[client.racer.ID]; !launched {
+			reactions[client.racer.ID] = launch_window
+			if client.conn != nil {
+				fmt.Fprintf(client.conn, "You were slow off the line! 🐌\n")
+			}
+		}
 	}
 
-	// send the buffer contents to each client
+	// set the race status to ongoing and every racer to running
+	server.race.StartWithReactions(reactions)
+	race := server.race.Snapshot()
+	race_log(server).Info("race started", "racers", len(race.Racers), "laps", race.MaxLaps)
+
+	// send a message to all clients that the race has started
 	for _, client := range server.clients {
-		if client.conn != nil {
-			fmt.Fprint(client.conn, buf.String())
+		if client.role == protocol.RoleSpectator {
+			fmt.Fprintln(client.conn, "The race has started!")
+		} else if client.conn != nil {
+			fmt.Fprintf(client.conn, "The race has started! Your reaction time was %.3fs. Good luck!\n", reactions[client.racer.ID].Seconds())
 		}
 	}
 
-	// print the buffer contents to the server console
-	fmt.Print(buf.String())
+	// the stewards penalize the jump starts
+	for id := range jump_starts {
+		send_events(server, server.race.PenalizeJumpStart(id))
+	}
 }
 
-// func update_race_status
-func update_race_status(server *Server) {
-	// loop through the racers and update their state
-	for i := range server.race.racers {
-		// get the racer object by reference
-		racer := &server.race.racers[i]
-
-		// check if the racer status is running
-		if racer.status == "running" {
-			// update the racer speed
-			update_racer_speed(racer)
-
-			// update the racer position
-			update_racer_position(racer)
-
-			// check if the racer position exceeds the lap distance
-			if racer.position >= server.race.lap_distance {
-				// update the racer lap
-				update_racer_lap(racer, server)
-
-				// check if the racer lap exceeds the max laps
-				if racer.current_lap > server.race.max_laps {
-					// update the racer status to finished
-					update_racer_status(racer, server)
-				}
+// func wait_for_launches: waits for the players' launch commands until a deadline
+// input: a pointer to a Server object, the deadline and the function called on each launch
+// output: none
+func wait_for_launches(server *Server, deadline time.Time, on_launch func(client_input)) {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return
+		case input := <-server.inputs:
+			// spectators have no car to launch
+			if input.racer != "" && strings.EqualFold(input.line, "go") {
+				on_launch(input)
 			}
+		}
+	}
+}
+
+// func drain_client_input: throws away the lines the players have sent so far
+// input: a pointer to a Server object
+// output: none
+func drain_client_input(server *Server) {
+	for {
+		select {
+		case <-server.inputs:
+		default:
+			return
+		}
+	}
+}
+
+// func read_client_input: sends every line a player types to the race until it disconnects, lines
+// that are too long or sent too fast are ignored
+// input: the channel to send the lines to, the player's Client object, the connection reader and the player's logger
+// output: none
+func read_client_input(inputs chan client_input, client Client, reader *bufio.Reader, logger *slog.Logger) {
+	bucket := guard.NewBucket(*inputRate, *inputBurst)
+	warned := false // the player was told it is sending too fast, it is told again once it slows down
+
+	for {
+		line, err := protocol.ReadLine(reader, *maxLine)
+		if errors.Is(err, protocol.ErrLineTooLong) {
+			limited_inputs.Inc(client.id, client.racer.Name)
+			fmt.Fprintf(client.conn, "Lines longer than %d bytes are ignored.\n", *maxLine)
+			continue
+		}
+		if err != nil {
+			// the player disconnected or was kicked, stop sending it messages
+			client.conn.Close()
+			connected_clients.Add(-1)
+			limited_inputs.Delete(client.id, client.racer.Name)
+			logger.Info("player disconnected", "error", err)
+
+			// the lobby forgets the players that leave it
+			inputs <- client_input{client.id, client.racer.ID, "", client.conn}
+			return
+		}
 
-			// check if the racer can overtake another racer on the same lane
-			if can_overtake(racer, &server.race) {
-				// update the racer lane and notify its client
-				update_racer_lane(racer, *server)
+		if !bucket.Allow(time.Now()) {
+			limited_inputs.Inc(client.id, client.racer.Name)
+			if !warned {
+				logger.Warn("player sending too fast")
+				fmt.Fprintln(client.conn, "You are sending commands too fast, they are ignored until you slow down. 🐌")
+				warned = true
 			}
+			continue
 		}
+		warned = false
+		inputs <- client_input{client.id, client.racer.ID, line, nil}
 	}
+}
 
-	// update the race status and current lap based on the racers' state
-	update_race_status_and_lap(&server.race)
+// func start_console: reads the operator's commands from the server's standard input
+// input: none
+// output: a channel that receives every line typed on the console, closed at the end of the input
+func start_console() chan string {
+	ch := make(chan string)
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			ch <- strings.TrimSpace(scanner.Text())
+		}
+		close(ch)
+	}()
+
+	return ch
 }
 
-// func update_racer_speed: updates the speed of a racer given the race conditions
-// input: a pointer to a Racer object
-// output: none (modifies the Racer object in place)
-func update_racer_speed(racer *Racer) {
-	// if the racer is on the first lap and has zero speed, accelerate quickly to its max speed
-	if racer.current_lap == 1 && racer.speed == 0 {
-		// increase the speed by a random factor between [0.5, 1.0) of the max speed
-		racer.speed += (rand.Float64() + 0.5) * racer.max_speed
-	} else {
-		// otherwise, adjust the speed randomly by a small amount
-		// increase or decrease the speed by a random factor between [-0.1, 0.1) of the max speed
-		racer.speed += (rand.Float64()*0.3 - 0.1) * racer.speed
+// func handle_command: runs a race control command typed on the server console
+// input: a pointer to a Server object and the command line
+// output: none (prints the result and notifies the clients of every action)
+func handle_command(server *Server, line string) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return
+	}
+
+	race_log(server).Info("race control command", "command", line)
+
+	switch fields[0] {
+	case "pause":
+		events := server.race.Suspend()
+		if len(events) == 0 {
+			fmt.Println("The race is not running.")
+			return
+		}
+		send_to_all(server, "The race has been paused by the race director. ⏸️")
+		send_events(server, events)
+
+	case "resume":
+		events := server.race.Resume()
+		if len(events) == 0 {
+			fmt.Println("The race is not paused.")
+			return
+		}
+		send_to_all(server, "The race has been resumed by the race director. ▶️")
+		send_events(server, events)
+
+	case "abort":
+		events := server.race.Abort()
+		if len(events) == 0 {
+			fmt.Println("The race is not running.")
+			return
+		}
+		send_to_all(server, "The race has been aborted by the race director. 🚩")
+		send_events(server, events)
+
+	case "restart":
+		server.race.Restart()
+		send_to_all(server, "The race director is restarting the race. 🔁")
+		start_race(server)
+
+	case "add-cpu":
+		name := next_cpu_name(*server)
+		server.race.AddRacer(name, true)
+		race_log(server).Info("CPU racer added", "racer", name)
+		send_to_all(server, fmt.Sprintf("%s was added to the race 💻", name))
+
+	case "kick":
+		name := strings.Join(fields[1:], " ")
+		racer, ok := find_racer_by_name(name, *server)
+		if !ok {
+			fmt.Printf("There is no racer named %q.\n", name)
+			return
+		}
+		if err := kick_racer(server, racer.ID, fmt.Sprintf("%s was kicked from the race by the race director. 👢", racer.Name)); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+	case "laps":
+		laps := 0
+		if len(fields) == 2 {
+			laps, _ = strconv.Atoi(fields[1])
+		}
+		if err := server.race.SetLaps(laps); err != nil {
+			fmt.Printf("Could not change the number of laps: %v\n", err)
+			return
+		}
+		send_to_all(server, fmt.Sprintf("The race director changed the race to %d laps.", laps))
+
+	case "status":
+		display_server_status(*server)
+
+	case "ban":
+		// a racer's name bans the address its player connected from and kicks it
+		target := strings.Join(fields[1:], " ")
+		racer, is_racer := find_racer_by_name(target, *server)
+		client := find_client_by_racer(racer.ID, *server)
+		if is_racer && client != nil {
+			target = guard.Address(client.address).String()
+		}
+		entry, err := server.bans.Add(target)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		race_log(server).Info("address banned", "address", entry)
+		fmt.Printf("%s is banned.\n", entry)
+		kick_banned(server)
+
+	case "unban":
+		entry := strings.Join(fields[1:], " ")
+		if err := server.bans.Remove(entry); err != nil {
+			fmt.Println(err)
+			return
+		}
+		race_log(server).Info("address unbanned", "address", entry)
+		fmt.Printf("%s is no longer banned.\n", entry)
 
-		// make sure the speed does not exceed the max speed or go below zero
-		if racer.speed > racer.max_speed {
-			racer.speed = racer.max_speed
-		} else if racer.speed < 0 {
-			racer.speed = 0
+	case "token":
+		if server.accounts == nil {
+			fmt.Println("Accounts are turned off.")
+			return
+		}
+		username := strings.Join(fields[1:], " ")
+		token, err := server.accounts.IssueToken(username)
+		if err != nil {
+			fmt.Println(err)
+			return
 		}
+		fmt.Printf("New token for %s, it replaces the previous one and is not shown again: %s\n", username, token)
+
+	default:
+		fmt.Println("Unknown command. Available commands: pause, resume, abort, restart, add-cpu, kick <name>, laps <n>, status, ban <name or address>, unban <address>, token <username>")
 	}
 }
 
-// func update_racer_position: updates the position of a racer based on its speed and time interval
-// input: a pointer to a Racer object
-// output: none (modifies the Racer object in place)
-func update_racer_position(racer *Racer) {
-	// assume the time interval is one second
-	// increase the position by the racer's current speed (in meters per second)
-	racer.position += int(racer.speed)
+// func handle_racer_command: runs a command a player typed during the race
+// input: a pointer to a Server object and the player's input
+// output: none (answers the player)
+func handle_racer_command(server *Server, input client_input) {
+	client := find_client(input.client_id, *server)
+	if client == nil || client.conn == nil {
+		return
+	}
+
+	// the simulator drives the car of a player that left until the player comes back
+	if input.left != nil {
+		if input.left == client.conn {
+			delete(server.controls, client.racer.ID)
+		}
+		return
+	}
+	if client.role == protocol.RoleSpectator {
+		fmt.Fprintln(client.conn, "Spectators cannot send commands to the race.")
+		return
+	}
+
+	fields := strings.Fields(input.line)
+	if len(fields) == 0 {
+		return
+	}
+
+	client_log(server, *client).Debug("player command", "command", input.line)
+
+	switch fields[0] {
+	case "pit":
+		// pit, pit slick or pit wet
+		tyre := ""
+		if len(fields) > 1 {
+			tyre = fields[1]
+		}
+		if err := server.race.RequestPit(client.racer.ID, tyre); err != nil {
+			fmt.Fprintf(client.conn, "Could not call you into the pit lane: %v\n", err)
+			return
+		}
+		fmt.Fprintln(client.conn, "Box, box! You go into the pit lane on your next lap. 🅿️")
+
+	case "throttle", "brake":
+		// throttle 80 or brake 100, in percent
+		percent := -1
+		if len(fields) == 2 {
+			percent, _ = strconv.Atoi(fields[1])
+		}
+		if percent < 0 || percent > 100 {
+			fmt.Fprintf(client.conn, "Type %s and a percentage between 0 and 100.\n", fields[0])
+			return
+		}
+
+		controls := player_controls(server, client.racer.ID)
+		if fields[0] == "throttle" {
+			controls.Throttle = float64(percent) / 100
+		} else {
+			controls.Brake = float64(percent) / 100
+		}
+		server.controls[client.racer.ID] = controls
+		fmt.Fprintf(client.conn, "You are driving with %.0f%% throttle and %.0f%% brake. 🎮\n", controls.Throttle*100, controls.Brake*100)
+
+	case "lane":
+		lane := 0
+		if len(fields) == 2 {
+			lane, _ = strconv.Atoi(fields[1])
+		}
+		if lanes := len(server.race.Snapshot().Lanes); lane < 1 || lane > lanes {
+			fmt.Fprintf(client.conn, "Type lane and a lane number between 1 and %d.\n", lanes)
+			return
+		}
+
+		controls := player_controls(server, client.racer.ID)
+		controls.Lane = lane
+		server.controls[client.racer.ID] = controls
+
+	case "auto":
+		// hand the car back to the CPU driver
+		delete(server.controls, client.racer.ID)
+		fmt.Fprintln(client.conn, "The CPU drives your car again. 🤖")
+
+	default:
+		fmt.Fprintln(client.conn, "Unknown command. Available commands: throttle <0-100>, brake <0-100>, lane <number>, auto, pit, pit slick, pit wet")
+	}
 }
 
-// func find_client_by_racer: finds the client that is associated with a given racer
-// input: a Racer object and a Server object
-// output: a pointer to a Client object or nil if no match is found
-func find_client_by_racer(racer Racer, server Server) *Client {
-	// loop through the clients in the race
-	for _, client := range server.clients {
-		// check if the client's racer name matches the given racer name
-		if client.racer.name == racer.name {
-			// return a pointer to the matching client
-			return &client
+// func player_controls: the controls of a racer driven by its player, a player taking the
+// controls from the CPU starts at full throttle
+// input: a pointer to a Server object and the racer's id
+// output: the racer's controls
+func player_controls(server *Server, id string) sim.Input {
+	controls, ok := server.controls[id]
+	if !ok {
+		controls = sim.Input{Throttle: 1}
+	}
+	return controls
+}
+
+// func kick_racer: takes a racer out of the race and disconnects its client (if any), the race
+// may be complete once it is gone
+// input: a pointer to a Server object, the racer's id and the message announcing it to everyone
+// output: an error if there is no racer with that id
+func kick_racer(server *Server, id string, announcement string) error {
+	events, err := server.race.RemoveRacer(id)
+	if err != nil {
+		return err
+	}
+	delete(server.controls, id)
+
+	for i, client := range server.clients {
+		if client.racer.ID == id {
+			client_log(server, client).Info("player kicked")
+			if client.conn != nil {
+				fmt.Fprintf(client.conn, "You have been kicked from the race by the race director.\n")
+				client.conn.Close()
+			}
+			server.clients = append(server.clients[:i], server.clients[i+1:]...)
+			break
 		}
 	}
 
-	// return nil if no match is found
+	send_to_all(server, announcement)
+	send_events(server, events)
 	return nil
 }
 
-// func update_racer_lap: updates the lap of a racer and resets its position to zero
-// input: a pointer to a Racer object and a Race object
-// output: none (modifies the Racer object in place)
-func update_racer_lap(racer *Racer, server *Server) {
-	// increment the lap by one
-	racer.current_lap++
+// func kick_banned: disconnects the clients connected from banned addresses, taking their racers out of the race
+// input: a pointer to a Server object
+// output: none (notifies the clients)
+func kick_banned(server *Server) {
+	for _, client := range slices.Clone(server.clients) {
+		if !server.bans.Banned(guard.Address(client.address)) {
+			continue
+		}
 
-	// reset the position to zero
-	racer.position = 0
+		if client.role != protocol.RoleSpectator && kick_racer(server, client.racer.ID, fmt.Sprintf("%s was banned from the server by the race director. 🚫", client.racer.Name)) == nil {
+			continue
+		}
 
-	// send a message to the client (if any) that the racer has completed a lap
-	if client := find_client_by_racer(*racer, *server); client != nil {
-		if client.conn != nil {
-			fmt.Fprintf(client.conn, "You have completed lap %d/%d.\n", racer.current_lap-1, server.race.max_laps)
+		// spectators, and racers already out of the race, are only disconnected
+		client_log(server, client).Info("client banned")
+		fmt.Fprintln(client.conn, "You have been banned from the server by the race director.")
+		client.conn.Close()
+		server.clients = slices.DeleteFunc(server.clients, func(other Client) bool { return other.id == client.id })
+	}
+}
+
+// func next_cpu_name: finds a name for a new CPU racer that no other racer is using
+// input: a Server object
+// output: the CPU racer's name
+func next_cpu_name(server Server) string {
+	return names.Numbered("CPU", len(server.race.Snapshot().Racers)+1, func(name string) bool {
+		return name_taken(server, name)
+	})
+}
+
+// func name_taken: tells if a racer already uses a name, whatever its case
+// input: a Server object and the name
+// output: true if the name is taken
+func name_taken(server Server, name string) bool {
+	_, taken := find_racer_by_name(name, server)
+	return taken
+}
+
+// func find_racer_by_name: finds a racer from the name the race director typed, whatever its case
+// input: the name and a Server object
+// output: a copy of the Racer object, and false if no racer has that name
+func find_racer_by_name(name string, server Server) (sim.Racer, bool) {
+	for _, racer := range server.race.Snapshot().Racers {
+		if strings.EqualFold(racer.Name, name) {
+			return racer, true
 		}
 	}
+	return sim.Racer{}, false
 }
 
-// func update_racer_status: updates the status of a racer to finished and adds it to the top three list if applicable
-// input: a pointer to a Racer object and a Race object
-// output: none (modifies the Racer and Race objects in place)
-func update_racer_status(racer *Racer, server *Server) {
-	// set the racer status to finished
-	racer.status = "finished"
+// func display_server_status: prints the state of the server and the race on the server console
+// input: a Server object
+// output: none
+func display_server_status(server Server) {
+	race := server.race.Snapshot()
+
+	fmt.Printf("Race status: %s (%s flag), lap %d/%d, %.1fs of race time\n", race.Status, race.Flag, race.CurrentLap, race.MaxLaps, race.Elapsed)
+	fmt.Printf("Clients connected: %d\n", len(server.clients))
+	if bans := server.bans.Entries(); len(bans) > 0 {
+		fmt.Printf("Banned: %s\n", strings.Join(bans, ", "))
+	}
+	for _, racer := range race.Racers {
+		kind := "player"
+		if racer.CPU {
+			kind = "cpu"
+		}
+		fmt.Printf("- %s (%s) %s, lap %d, lane %d\n", racer.Name, kind, racer.Status, racer.CurrentLap, racer.Lane)
+	}
+}
 
-	// send a message to the client (if any) that the racer has finished the race
-	if client := find_client_by_racer(*racer, *server); client != nil {
+// func send_to_all: sends a message to every client and prints it on the server console
+// input: a pointer to a Server object and the message
+// output: none
+func send_to_all(server *Server, message string) {
+	for _, client := range server.clients {
 		if client.conn != nil {
-			fmt.Fprintf(client.conn, "You have finished the race!\n")
+			fmt.Fprintln(client.conn, message)
 		}
 	}
 
-	// check if the top three list is full or not
-	var cars_in_podium = len(server.race.top_three)
-	if cars_in_podium < 3 {
-		// add the racer to the top three list
-		server.race.top_three = append(server.race.top_three, *racer)
+	fmt.Fprintln(server.board, message)
+}
 
-		// send a message to the client (if any) that the racer has made it to the podium
-		if client := find_client_by_racer(*racer, *server); client != nil {
-			if client.conn != nil {
-				fmt.Fprintf(client.conn, "You have made it to the podium! Your position was: %d\nCongratulations!\n", cars_in_podium+1)
+// func wait_for_restart: lets the operator use the console once the race is over
+// input: a pointer to a Server object
+// output: true if the race was restarted, false if the game should end
+func wait_for_restart(server *Server) bool {
+	if server.console == nil {
+		return false
+	}
+
+	fmt.Println("Type restart to race again, or press ENTER to end the game.")
+
+	for {
+		select {
+		case request := <-server.joins:
+			// players can join for the next race
+			join_late(server, request)
+		case line, ok := <-server.console:
+			if !ok {
+				// the console was closed
+				return false
+			}
+			if line == "" {
+				return false
+			}
+
+			handle_command(server, line)
+			if server.race.Snapshot().Status == sim.RaceOngoing {
+				return true
 			}
 		}
 	}
 }
 
-// func can_overtake: checks if a racer can overtake another racer on the same lane that is slower than it
-// input: a Racer object and a Race object
-// output: a boolean value indicating whether overtaking is possible or not
-func can_overtake(racer *Racer, race *Race) bool {
-	// loop through the other racers in the race
-	for _, other := range race.racers {
-		// check if the other racer is on the same lane as the racer
-		if other.lane == racer.lane {
-			// check if the other racer is slower than the racer and is within a certain distance (e.g. 10 meters)
-			var can_overtake = math.Abs(float64(other.position-racer.position)) <= 10
-			if other.speed < racer.speed && can_overtake {
-				// return true if overtaking is possible
-				return true
-			}
+// func display_race_status
+func display_race_status(server *Server) {
+	// get a copy of the race state from the server
+	race := server.race.Snapshot()
+
+	// create a buffer to store the formatted output
+	var buf bytes.Buffer
+
+	// write the race status to the buffer
+	fmt.Fprintf(&buf, "\nRace 🏁 status: %s\n", race.Status)
+	fmt.Fprintf(&buf, "Flag: %s\n", flag_display(race.Flag))
+	fmt.Fprintf(&buf, "Weather: %s (%.0f%% wet)\n", weather_display(race.Weather.State), race.Weather.Wetness*100)
+	if race.Weather.Forecast != "" {
+		fmt.Fprintf(&buf, "Forecast: %s\n", race.Weather.Forecast)
+	}
+	fmt.Fprintf(&buf, "Latest Lap: %d/%d\n", race.CurrentLap, race.MaxLaps)
+
+	// the racers are listed in the order they are running in
+	racers := map[string]sim.Racer{}
+	for _, racer := range race.Racers {
+		racers[racer.ID] = racer
+	}
+
+	// loop through the standings and write each racer's info to the buffer
+	for _, standing := range race.Standings {
+		racer := racers[standing.ID]
+
+		// write the racer's place, the positions it has gained or lost and its gap to the leader
+		fmt.Fprintf(&buf, "P%d %s %s | ", standing.Position, gained_display(standing.Gained), gap_display(standing))
+
+		// draw the racer with a lane number, a car emoji, and a progress bar
+		position := int(racer.Position)
+		lap_distance := int(race.LapDistance)
+		fmt.Fprintf(&buf, "%d 🏎️ [%s>%s]", racer.Lane, strings.Repeat("=", position/10), strings.Repeat(" ", (lap_distance-position)/10))
+
+		lap_display := fmt.Sprintf("Lap: %d/%d", racer.CurrentLap, race.MaxLaps)
+
+		if racer.Status == sim.StatusFinished {
+			lap_display = "Finished! 🏁"
+		} else if racer.Status == sim.StatusRetired {
+			lap_display = "DNF 💥"
+		} else if racer.Status == sim.StatusDisqualified {
+			lap_display = "DSQ 🏴"
+		}
+
+		// write the racer's name, speed, position and damage (if any) to the buffer
+		fmt.Fprintf(&buf, "%s - %s (%.2f m/s) %d/%dm", lap_display, racer.Name, racer.Speed, position, lap_distance)
+		if racer.Damage > 0 {
+			fmt.Fprintf(&buf, " 🔧 %.0f%% damage", racer.Damage*100)
+		}
+		fmt.Fprintf(&buf, " 🛞 %s", racer.Tyre)
+		if racer.Status == sim.StatusRunning && racer.Slipstream > 0 {
+			fmt.Fprint(&buf, " 💨 slipstream")
+		}
+
+		// write the racer's pending penalties and pit lane visits to the buffer
+		if racer.PenaltyTime > 0 {
+			fmt.Fprintf(&buf, " ⏱️ +%.0fs", racer.PenaltyTime)
+		}
+		if racer.DriveThrough {
+			fmt.Fprint(&buf, " ⚠️ drive-through")
+		}
+		if racer.InPit {
+			fmt.Fprint(&buf, " 🅿️ pit lane")
+		}
+		if racer.Status == sim.StatusRunning && racer.BlueFlag {
+			fmt.Fprint(&buf, " 🟦 blue flag")
+		}
+		fmt.Fprintln(&buf)
+	}
+
+	// queue the buffer contents for each client, replacing the board it has not been sent yet
+	sending := time.Now()
+	for _, client := range server.clients {
+		if client.conn != nil {
+			client.conn.Board(buf.String())
 		}
 	}
+	broadcast_latency.Observe(time.Since(sending).Seconds())
 
-	// return false as overtaking is not possible
-	return false
+	// print the buffer contents to the server console
+	fmt.Fprint(server.board, buf.String())
 }
 
-// func update_racer_lane: updates the lane of a racer to an adjacent lane that is free of other racers
-// input: a pointer to a Racer object and a Race object
-// output: none (modifies the Racer object in place)
-func update_racer_lane(racer *Racer, server Server) {
-	// get the current lane of the racer
-	current_lane := racer.lane
+// func update_race_status
+func update_race_status(server *Server, dt time.Duration) {
+	stepping := time.Now()
+
+	// advance the race by dt, the simulator drives the racers whose players did not take the controls
+	events := server.race.Step(dt, server.controls)
+	send_events(server, events)
 
-	// get the list of available lanes in the race
-	available_lanes := server.race.lanes
+	// a lane change is asked for once, the throttle and the brake stay where the player left them
+	for id, controls := range server.controls {
+		controls.Lane = 0
+		server.controls[id] = controls
+	}
+
+	tick_duration.Observe(time.Since(stepping).Seconds())
 
-	// create a list of adjacent lanes to the current lane
-	adjacent_lanes := []int{}
+	race := server.race.Snapshot()
+	update_leader_metrics(server, race)
 
-	// loop through the available lanes
-	for _, lane := range available_lanes {
-		// check if the lane is adjacent to the current lane (i.e. one unit difference)
-		var distance_to_lane = math.Abs(float64(lane - current_lane))
-		if distance_to_lane <= 1.005 && distance_to_lane >= 0.995 {
-			// add the lane to the adjacent lanes list
-			adjacent_lanes = append(adjacent_lanes, lane)
+	// record the step, no time passes while the race is suspended
+	if server.telemetry != nil && race.Flag != sim.FlagRed {
+		rows := telemetry.Rows(server.race_number, race, events)
+		if err := server.telemetry.Write(rows); err != nil {
+			race_log(server).Error("telemetry stopped", "error", err)
+			server.telemetry = nil
 		}
 	}
+}
 
-	// check if there are any adjacent lanes available
-	if len(adjacent_lanes) > 0 {
-		// choose a random adjacent lane from the list
-		new_lane := adjacent_lanes[rand.Intn(len(adjacent_lanes))]
+// func update_leader_metrics: sets the gauges of the racer leading the race
+// input: a pointer to a Server object and a snapshot of the race
+// output: none
+func update_leader_metrics(server *Server, race sim.Snapshot) {
+	if len(race.Standings) == 0 {
+		return
+	}
 
-		// update the racer's lane to the new lane
-		racer.lane = new_lane
+	number := strconv.Itoa(server.race_number)
+	for _, racer := range race.Racers {
+		if racer.ID == race.Standings[0].ID {
+			leader_speed.Set(racer.Speed, number)
+			// a finished racer is past the last lap
+			leader_lap.Set(float64(min(racer.CurrentLap, race.MaxLaps)), number)
+		}
+	}
+}
+
+// func send_events: sends race events to the clients
+// input: a pointer to a Server object and the events
+// output: none
+func send_events(server *Server, events []sim.Event) {
+	for _, event := range events {
+		// log every stewards' decision, the other events are only logged when debugging
+		level := slog.LevelDebug
+		if event.Kind == sim.EventPenalty {
+			level = slog.LevelInfo
+		}
+		race_log(server).Log(context.Background(), level, "race event", "kind", event.Kind, "racer_id", event.Racer, "text", event.Text)
+
+		// events of the whole race, like flag changes, go to everybody
+		if event.Racer == "" {
+			send_to_all(server, event.Text)
+			continue
+		}
 
-		// send a message to the client (if any) that the racer has changed lanes
-		if client := find_client_by_racer(*racer, server); client != nil {
+		// send each racer event to the client (if any) of the racer it belongs to
+		if client := find_client_by_racer(event.Racer, *server); client != nil {
 			if client.conn != nil {
-				fmt.Fprintf(client.conn, "You have changed lanes from %d to %d.\n", current_lane, new_lane)
+				fmt.Fprintln(client.conn, event.Text)
 			}
 		}
 	}
 }
 
-// update the race status and current lap based on the racers' state
-// input: a pointer to a Race object
-// output: none (modifies the Race object in place)
-func update_race_status_and_lap(race *Race) {
-	// create a variable to store the maximum lap among the racers
-	max_lap := 1
+// func flag_display: the flag as shown on the race board
+// input: one of the sim flag states
+// output: the flag with its emoji
+func flag_display(flag string) string {
+	switch flag {
+	case sim.FlagGreen:
+		return "🟢 green"
+	case sim.FlagYellow:
+		return "🟨 yellow"
+	case sim.FlagSafetyCar:
+		return "🚨 safety car"
+	case sim.FlagRed:
+		return "🟥 red"
+	case sim.FlagChequered:
+		return "🏁 chequered"
+	}
+	return flag
+}
 
-	// create a variable to store the number of racers who have finished the race
-	finished_racers := 0
+// func gained_display: the positions a racer has gained or lost since the start as shown on the race board
+// input: the positions gained, negative when lost
+// output: the positions with an arrow
+func gained_display(gained int) string {
+	if gained > 0 {
+		return fmt.Sprintf("▲%d", gained)
+	} else if gained < 0 {
+		return fmt.Sprintf("▼%d", -gained)
+	}
+	return "="
+}
 
-	// loop through the racers in the race
-	for _, racer := range race.racers {
-		// check if the racer's current lap is greater than the maximum lap
-		if racer.current_lap > max_lap {
-			// update the maximum lap to the racer's current lap
-			max_lap = racer.current_lap
-		}
+// func gap_display: the gap of a racer to the leader and to the car ahead as shown on the race board
+// input: a sim Standing object
+// output: the gaps
+func gap_display(standing sim.Standing) string {
+	if standing.Position == 1 {
+		return "Leader"
+	}
+	if standing.Status == sim.StatusRetired || standing.Status == sim.StatusDisqualified {
+		return "-"
+	}
+	if standing.LapsDown > 0 {
+		return fmt.Sprintf("+%d lap(s)", standing.LapsDown)
+	}
+	return fmt.Sprintf("+%.1fs (int +%.1fs)", standing.Gap, standing.Interval)
+}
 
-		// check if the racer's status is finished
-		if racer.status == "finished" {
-			// increment the finished racers count by one
-			finished_racers++
-		}
+// func weather_display: the weather as shown on the race board
+// input: one of the sim weather states
+// output: the weather with its emoji
+func weather_display(state string) string {
+	switch state {
+	case sim.WeatherDry:
+		return "☀️ dry"
+	case sim.WeatherDamp:
+		return "🌥️ damp"
+	case sim.WeatherWet:
+		return "🌧️ wet"
+	case sim.WeatherChanging:
+		return "🌦️ changing"
+	}
+	return state
+}
+
+// func new_logger: creates the server's logger from the logging flags
+// input: the writer to send the log records to
+// output: a pointer to a slog.Logger object, or an error if a flag has an unknown value
+func new_logger(w io.Writer) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return nil, errors.New("logLevel must be debug, info, warn or error")
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
 	}
+	return nil, errors.New("logFormat must be text or json")
+}
 
-	// update the race's current lap to the maximum lap
-	race.current_lap = max_lap
+// func fatal: logs an error that stops the server and exits
+// input: the logger, the message and its attributes
+// output: none (exits the program)
+func fatal(logger *slog.Logger, message string, args ...any) {
+	logger.Error(message, args...)
+	os.Exit(1)
+}
 
-	// check if all racers have finished the race
-	if finished_racers == len(race.racers) {
-		// update the race's status to complete
-		race.status = "complete"
+// func race_log: the server's logger with the race being run attached to every record
+// input: a pointer to a Server object
+// output: a pointer to a slog.Logger object, without a race before the first one starts
+func race_log(server *Server) *slog.Logger {
+	if server.race_number == 0 {
+		return server.log
 	}
+	return server.log.With("race", server.race_number)
+}
+
+// func client_log: the server's logger with the race, the client and its racer attached to every record
+// input: a pointer to a Server object and the Client object
+// output: a pointer to a slog.Logger object
+func client_log(server *Server, client Client) *slog.Logger {
+	return race_log(server).With("client", client.id, "racer", client.racer.Name)
+}
+
+// func find_client: finds a client by its id
+// input: the client's id and a Server object
+// output: a pointer to a Client object or nil if no match is found
+func find_client(id string, server Server) *Client {
+	for _, client := range server.clients {
+		if client.id == id {
+			return &client
+		}
+	}
+	return nil
+}
+
+// func find_client_by_racer: finds the client that is associated with a given racer
+// input: the racer's id and a Server object
+// output: a pointer to a Client object or nil if no match is found
+func find_client_by_racer(id string, server Server) *Client {
+	// loop through the clients in the race
+	for _, client := range server.clients {
+		// check if the client's racer id matches the given racer id, spectators have no racer
+		if client.racer.ID != "" && client.racer.ID == id {
+			// return a pointer to the matching client
+			return &client
+		}
+	}
+
+	// return nil if no match is found
+	return nil
 }
 
 // display_podium: displays the podium with the top three racers, their names, and positions
-// input: a Race object
+// input: a Server object
 // output: none (prints to the server console and sends to each client)
 func display_podium(server Server) {
-	// check if the race has a top three list
-	if len(server.race.top_three) == 3 {
-		// create a buffer to store the formatted output
-		var buf bytes.Buffer
+	race := server.race.Snapshot()
+
+	// create a buffer to store the formatted output
+	var buf bytes.Buffer
 
+	// check if anybody finished the race
+	if len(race.TopThree) == 0 {
+		fmt.Fprintln(&buf, "\nThe race is over! Nobody made it to the finish line.")
+	} else {
 		// write a header message to the buffer
 		fmt.Fprintln(&buf, "\nThe race is over! Here are the results:")
 
@@ -596,27 +2027,61 @@ func display_podium(server Server) {
 		fmt.Fprintln(&buf, " /__|__\\ /__|__\\ /__|__\\")
 		fmt.Fprintln(&buf, "|  ___  |  ___  |  ___  |")
 		fmt.Fprintln(&buf, "| (___) | (___) | (___) |")
-		fmt.Fprintln(&buf, "|_______|_______|_______|\n")
+		fmt.Fprint(&buf, "|_______|_______|_______|\n\n")
+
+		// loop through the podium places and write the names of the racers that took them
+		for i := 0; i < 3; i++ {
+			if i < len(race.TopThree) {
+				racer := race.TopThree[i]
+				fmt.Fprintf(&buf, "%d. %s (%.3fs", i+1, racer.Name, racer.FinishTime+racer.PenaltyTime)
+				if racer.PenaltyTime > 0 {
+					fmt.Fprintf(&buf, " with %.0fs of penalties", racer.PenaltyTime)
+				}
+				fmt.Fprintln(&buf, ")")
+			} else {
+				fmt.Fprintf(&buf, "%d. (no finisher)\n", i+1)
+			}
+		}
+	}
 
-		// loop through the top three racers and write their names and positions to the buffer
-		for i, racer := range server.race.top_three {
-			// write the racer name and position to the buffer
-			fmt.Fprintf(&buf, "%d. %s\n", i+1, racer.name)
+	// list every racer in finishing order, with the gap to the winner
+	if len(race.Results) > 0 {
+		fmt.Fprintln(&buf, "\nClassification:")
+	}
+	for _, racer := range race.Results {
+		switch racer.Status {
+		case sim.StatusFinished:
+			fmt.Fprintf(&buf, "%d. %s %s (best lap %.3fs, theoretical %.3fs)\n", racer.Place, racer.Name,
+				classification_gap(racer, race.Results[0]), racer.BestLap(), racer.TheoreticalLap())
+		case sim.StatusRetired:
+			fmt.Fprintf(&buf, "%d. %s DNF 💥 (lap %d)\n", racer.Place, racer.Name, racer.CurrentLap)
+		case sim.StatusDisqualified:
+			fmt.Fprintf(&buf, "DSQ. %s 🏴\n", racer.Name)
 		}
+	}
 
-		// send the buffer contents to each client
-		for _, client := range server.clients {
-			if client.conn != nil {
-				fmt.Fprint(client.conn, buf.String())
-			}
+	// send the buffer contents to each client
+	for _, client := range server.clients {
+		if client.conn != nil {
+			fmt.Fprint(client.conn, buf.String())
 		}
+	}
 
-		// print the buffer contents to the server console
-		fmt.Print(buf.String())
-	} else {
-		// print an error message if the race does not have a top three list
-		fmt.Println("The race does not have a top three list.")
+	// print the buffer contents to the server console
+	fmt.Fprint(server.board, buf.String())
+}
+
+// func classification_gap: the gap of a finisher to the winner as shown in the classification
+// input: the finisher and the winner
+// output: the winner's race time, the gap in seconds or the laps it is down
+func classification_gap(racer sim.Racer, winner sim.Racer) string {
+	if racer.ID == winner.ID {
+		return fmt.Sprintf("%.3fs", racer.FinishTime+racer.PenaltyTime)
+	}
+	if laps := len(winner.LapTimes) - len(racer.LapTimes); laps > 0 {
+		return fmt.Sprintf("+%d lap(s)", laps)
 	}
+	return fmt.Sprintf("+%.3fs", racer.FinishTime+racer.PenaltyTime-winner.FinishTime-winner.PenaltyTime)
 }
 
 // end_game: sends a message to each client to thank them for playing, and then ends the game and disconnects the clients
@@ -628,16 +2093,28 @@ func end_game(server Server) {
 		if client.conn != nil {
 			// send a message to the client to thank them for playing
 			fmt.Fprintf(client.conn, "Thank you for playing! Hope you had fun!\n")
-			// close the client's connection
+			// close the client's connection once its messages are sent
 			client.conn.Close()
 		}
 	}
 
-	// print a message to the server console to indicate the game is over
-	fmt.Println("The game is over! Press ENTER to exit.")
+	// wait for the last messages, a stalled client gives up after the write timeout
+	for _, client := range server.clients {
+		if client.conn != nil {
+			<-client.conn.Done()
+		}
+	}
+
+	// write the telemetry still buffered
+	if server.telemetry != nil {
+		if err := server.telemetry.Close(); err != nil {
+			server.log.Error("could not write the telemetry", "error", err)
+		}
+		server.telemetry_file.Close()
+	}
 
-	// wait for the user to press enter
-	fmt.Scanln()
+	// log that the game is over
+	server.log.Info("game over", "races", server.race_number)
 
 	// exit the program
 	os.Exit(0)
@@ -0,0 +1,236 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// type Entry: a number of cars of the same profile taking part in every batch race
+type Entry struct {
+	Profile Profile
+	Count   int
+}
+
+// type BatchConfig: the settings of a headless batch of races
+type BatchConfig struct {
+	Race    Config        // settings of each race, race i is seeded with Race.Seed + i
+	Entries []Entry       // cars taking part in each race
+	Races   int           // number of races to run
+	Workers int           // number of races simulated at the same time
+	Step    time.Duration // simulated time advanced on every step
+}
+
+// type ProfileStats: the results of every car of a profile across a batch
+type ProfileStats struct {
+	Profile         string
+	Starts          int
+	Wins            int
+	Podiums         int
+	Finishes        int
+	Retirements     int
+	AveragePosition float64
+	LapTimes        Distribution
+}
+
+// func WinRate: fraction of the starts that ended in a win
+func (stats ProfileStats) WinRate() float64 {
+	return ratio(stats.Wins, stats.Starts)
+}
+
+// func PodiumRate: fraction of the starts that ended in the podium
+func (stats ProfileStats) PodiumRate() float64 {
+	return ratio(stats.Podiums, stats.Starts)
+}
+
+// func RetirementRate: fraction of the starts that ended in a retirement (DNF)
+func (stats ProfileStats) RetirementRate() float64 {
+	return ratio(stats.Retirements, stats.Starts)
+}
+
+// type Distribution: summary of a set of samples
+type Distribution struct {
+	Count  int
+	Mean   float64
+	StdDev float64
+	Min    float64
+	P50    float64
+	P90    float64
+	Max    float64
+}
+
+// the result of a single batch race for one car
+type batch_result struct {
+	profile  string
+	place    int
+	status   string
+	lap_time []float64
+}
+
+// func RunBatch: runs a batch of races without real time delays across a pool of workers
+// input: a BatchConfig object
+// output: the statistics of each profile, in the order the profiles appear in the entries
+func RunBatch(cfg BatchConfig) []ProfileStats {
+	if cfg.Workers < 1 {
+		cfg.Workers = 1
+	}
+	if cfg.Step <= 0 {
+		cfg.Step = time.Second
+	}
+
+	jobs := make(chan int)
+	results := make(chan []batch_result)
+
+	// start the workers, each one runs whole races taken from the jobs channel
+	var wg sync.WaitGroup
+	for w := 0; w < cfg.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results <- run_batch_race(cfg, cfg.Race.Seed+int64(i))
+			}
+		}()
+	}
+
+	// feed the race numbers to the workers and close the results once they are done
+	go func() {
+		for i := 0; i < cfg.Races; i++ {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	// collect the results of every race grouped by profile
+	order := []string{}
+	by_profile := map[string][]batch_result{}
+	for _, entry := range cfg.Entries {
+		if _, ok := by_profile[entry.Profile.Name]; !ok {
+			order = append(order, entry.Profile.Name)
+			by_profile[entry.Profile.Name] = nil
+		}
+	}
+	for race_results := range results {
+		for _, result := range race_results {
+			by_profile[result.profile] = append(by_profile[result.profile], result)
+		}
+	}
+
+	stats := []ProfileStats{}
+	for _, name := range order {
+		stats = append(stats, profile_stats(name, by_profile[name]))
+	}
+	return stats
+}
+
+// func run_batch_race: runs one race of a batch until every car finishes or retires
+// input: a BatchConfig object and the seed of the race
+// output: the result of every car in the race
+func run_batch_race(cfg BatchConfig, seed int64) []batch_result {
+	race_cfg := cfg.Race
+	race_cfg.Seed = seed
+	race := NewRace(race_cfg)
+
+	for _, entry := range cfg.Entries {
+		for i := 0; i < entry.Count; i++ {
+			race.AddRacerWithProfile(fmt.Sprintf("%s %d", entry.Profile.Name, i+1), entry.Profile, true)
+		}
+	}
+
+	race.Start()
+	for !race.Complete() {
+		race.Step(cfg.Step, nil)
+	}
+
+	results := []batch_result{}
+	for _, racer := range race.Snapshot().Racers {
+		results = append(results, batch_result{racer.Profile, racer.Place, racer.Status, racer.LapTimes})
+	}
+	return results
+}
+
+// func profile_stats: aggregates the results of the cars of a profile
+// input: the profile name and the results of its cars
+// output: a ProfileStats object
+func profile_stats(name string, results []batch_result) ProfileStats {
+	stats := ProfileStats{Profile: name}
+	positions := 0
+	lap_times := []float64{}
+
+	for _, result := range results {
+		stats.Starts++
+		lap_times = append(lap_times, result.lap_time...)
+		if result.status == StatusRetired {
+			stats.Retirements++
+		}
+
+		// retirements are classified too but only the finishers count for the positions
+		if result.status != StatusFinished {
+			continue
+		}
+		stats.Finishes++
+		positions += result.place
+		if result.place == 1 {
+			stats.Wins++
+		}
+		if result.place <= 3 {
+			stats.Podiums++
+		}
+	}
+
+	if stats.Finishes > 0 {
+		stats.AveragePosition = float64(positions) / float64(stats.Finishes)
+	}
+	stats.LapTimes = distribution(lap_times)
+	return stats
+}
+
+// func distribution: summarizes a set of samples
+// input: the samples, they get sorted in place
+// output: a Distribution object
+func distribution(samples []float64) Distribution {
+	dist := Distribution{Count: len(samples)}
+	if len(samples) == 0 {
+		return dist
+	}
+
+	sort.Float64s(samples)
+
+	sum := 0.0
+	for _, sample := range samples {
+		sum += sample
+	}
+	dist.Mean = sum / float64(len(samples))
+
+	variance := 0.0
+	for _, sample := range samples {
+		variance += (sample - dist.Mean) * (sample - dist.Mean)
+	}
+	dist.StdDev = math.Sqrt(variance / float64(len(samples)))
+
+	dist.Min = samples[0]
+	dist.P50 = percentile(samples, 0.5)
+	dist.P90 = percentile(samples, 0.9)
+	dist.Max = samples[len(samples)-1]
+	return dist
+}
+
+// func percentile: nearest-rank percentile of sorted samples
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func ratio(part int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
@@ -0,0 +1,129 @@
+package sim
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// finishers closer than this on the line are shown on a photo finish, in seconds
+const photo_finish_gap = 0.1
+
+// type crossing: a racer crossing the line during a step
+type crossing struct {
+	racer *Racer
+	time  time.Duration // race time when the racer crossed the line
+}
+
+// func crossing_time: works out when a racer that just went past a line on the lap crossed it,
+// racers move at a constant speed during a step so the time is interpolated between the ticks
+// input: a pointer to a Racer object and the position of the line on the lap, which the racer is past
+// output: the race time of the crossing
+func (race *Race) crossing_time(racer *Racer, line float64) time.Duration {
+	if racer.Speed <= 0 {
+		return race.elapsed
+	}
+
+	past := (racer.Position - line) / racer.Speed
+	return race.elapsed - time.Duration(past*float64(time.Second))
+}
+
+// func classify: ranks every racer once the race is complete, the finishers first by laps
+// completed and race time with the stewards' time penalties added, then the retirements by
+// distance covered and the disqualified racers last without a place
+// input: none
+// output: the podium and photo finish events
+func (race *Race) classify() []Event {
+	order := []*Racer{}
+	for i := range race.racers {
+		order = append(order, &race.racers[i])
+	}
+
+	sort.SliceStable(order, func(a, b int) bool {
+		return race.classified_ahead(order[a], order[b])
+	})
+
+	events := []Event{}
+	race.top_three = nil
+	race.classification = nil
+	for i, racer := range order {
+		racer.Place = i + 1
+		if racer.Status == StatusDisqualified {
+			racer.Place = 0
+		}
+
+		if racer.Status == StatusFinished && i < 3 {
+			race.top_three = append(race.top_three, *racer)
+			events = append(events, podium_event(racer.ID, racer.Place))
+		}
+
+		// finishers on the same lap too close to call are told apart by the photo
+		if i > 0 && racer.Status == StatusFinished && order[i-1].Status == StatusFinished && len(racer.LapTimes) == len(order[i-1].LapTimes) {
+			if gap := race_time(racer) - race_time(order[i-1]); gap < photo_finish_gap {
+				events = append(events, photo_finish_event(order[i-1].Name, racer.Name, gap))
+			}
+		}
+	}
+
+	for _, racer := range order {
+		race.classification = append(race.classification, *racer)
+	}
+
+	return events
+}
+
+// func classified_ahead: tells if a racer is classified ahead of another one, racers with the
+// same race time are split by who really crossed the line first, then by their fastest lap
+// and then by name
+// input: pointers to the two Racer objects
+// output: a boolean value
+func (race *Race) classified_ahead(a *Racer, b *Racer) bool {
+	if group_a, group_b := classification_group(a), classification_group(b); group_a != group_b {
+		return group_a < group_b
+	}
+
+	if a.Status == StatusFinished {
+		if len(a.LapTimes) != len(b.LapTimes) {
+			return len(a.LapTimes) > len(b.LapTimes)
+		}
+		if race_time(a) != race_time(b) {
+			return race_time(a) < race_time(b)
+		}
+		if a.FinishTime != b.FinishTime {
+			return a.FinishTime < b.FinishTime
+		}
+		if a.BestLap() != b.BestLap() {
+			return a.BestLap() < b.BestLap()
+		}
+		return a.Name < b.Name
+	}
+
+	// the racers out of the race are ranked by how far they got
+	if a.Distance != b.Distance {
+		return a.Distance > b.Distance
+	}
+	return a.Name < b.Name
+}
+
+// func classification_group: finishers come first, then the retirements and the disqualified racers last
+func classification_group(racer *Racer) int {
+	switch racer.Status {
+	case StatusFinished:
+		return 0
+	case StatusDisqualified:
+		return 2
+	}
+	return 1
+}
+
+// func race_time: the race time of a finisher with the stewards' time penalties added, in seconds
+func race_time(racer *Racer) float64 {
+	return racer.FinishTime + racer.PenaltyTime
+}
+
+// func photo_finish_event: creates the event sent to every racer when two finishers are too close to call
+// input: the names of the racer ahead and the racer behind and the gap between them in seconds
+// output: an Event object
+func photo_finish_event(ahead string, behind string, gap float64) Event {
+	return Event{Kind: EventPhotoFinish, Text: fmt.Sprintf("📸 Photo finish! %s beats %s by %.3f seconds.", ahead, behind, gap)}
+}
@@ -0,0 +1,94 @@
+package sim
+
+import "fmt"
+
+const (
+	car_length        = 5.0  // cars closer than this on the same lane overlap, in meters
+	damage_per_speed  = 0.02 // damage taken for each m/s of closing speed in a collision
+	damage_speed_loss = 0.5  // fraction of the max speed lost by a fully damaged car
+	retire_damage     = 0.8  // damage at which a car has to retire from the race
+	impact_slowdown   = 0.7  // fraction of their speed cars keep after a collision
+
+	wet_collision_factor = 2.0 // extra collision chance for each fraction of the top speed lost to the wet
+)
+
+// func check_collisions: lets cars that overlap on the same lane touch, damaging both of them
+// input: none
+// output: the collision and retirement events
+func (race *Race) check_collisions() []Event {
+	// the pairs of cars only roll for a touch when collisions are turned on
+	if race.config.CollisionChance <= 0 {
+		return nil
+	}
+
+	events := []Event{}
+
+	for i := range race.racers {
+		for j := i + 1; j < len(race.racers); j++ {
+			a, b := &race.racers[i], &race.racers[j]
+			if a.Status != StatusRunning || b.Status != StatusRunning || a.Lane != b.Lane {
+				continue
+			}
+
+			// find which car is behind, the one behind can only hit the other one if it is faster
+			rear, front := a, b
+			if a.Position > b.Position {
+				rear, front = b, a
+			}
+			closing_speed := rear.Speed - front.Speed
+			if front.Position-rear.Position >= car_length || closing_speed <= 0 {
+				continue
+			}
+
+			// cars with less grip touch more easily
+			chance := race.config.CollisionChance * (1 + wet_collision_factor*max(rear.grip_loss, front.grip_loss))
+			if race.rng.Float64() >= chance {
+				continue
+			}
+
+			events = append(events, race.collide(rear, front, closing_speed)...)
+		}
+	}
+
+	return events
+}
+
+// func collide: damages two cars that touched and retires the ones too damaged to continue
+// input: pointers to the car behind and the car in front, and the speed they closed in at
+// output: the collision and retirement events
+func (race *Race) collide(rear *Racer, front *Racer, closing_speed float64) []Event {
+	damage := closing_speed * damage_per_speed * (0.5 + race.rng.Float64())
+
+	events := []Event{}
+	for _, pair := range [][2]*Racer{{rear, front}, {front, rear}} {
+		racer, other := pair[0], pair[1]
+
+		racer.Damage = min(1, racer.Damage+damage)
+		racer.Speed *= impact_slowdown
+		events = append(events, collision_event(racer.ID, other.Name, racer.Damage))
+	}
+
+	// the car behind cannot go through the one it hit
+	rear.Speed = min(rear.Speed, front.Speed)
+
+	for _, racer := range []*Racer{rear, front} {
+		if racer.Damage >= retire_damage {
+			events = append(events, race.retire(racer)...)
+		}
+	}
+
+	return events
+}
+
+// func retire: takes a racer that cannot continue out of the race and brings out the safety car
+// input: a pointer to a Racer object
+// output: the retirement and flag events
+func (race *Race) retire(racer *Racer) []Event {
+	racer.Status = StatusRetired
+	racer.Speed = 0
+
+	events := []Event{retire_event(racer.ID)}
+	events = append(events, Event{Kind: EventRetired, Text: fmt.Sprintf("💥 %s is out of the race (DNF).", racer.Name)})
+	events = append(events, race.DeploySafetyCar(racer.Name+" has crashed out.")...)
+	return events
+}
@@ -0,0 +1,130 @@
+package sim
+
+import (
+	"errors"
+	"fmt"
+)
+
+// func Abort: stops an ongoing race under a red flag without finishing it
+// input: none
+// output: the flag event, if the race was ongoing
+func (race *Race) Abort() []Event {
+	if race.status != RaceOngoing {
+		return nil
+	}
+
+	race.status = RaceAborted
+	race.flag = FlagRed
+	return []Event{flag_event(FlagRed, "🟥 Red flag! The race has been stopped and will not be resumed.")}
+}
+
+// func Over: tells if the race has been completed or aborted
+// input: none
+// output: a boolean value
+func (race *Race) Over() bool {
+	return race.status == RaceComplete || race.status == RaceAborted
+}
+
+// func Restart: puts every racer back on the start line and the race back to not started,
+// the racers keep their cars and lanes but the random choices continue from where they were,
+// the weather starts over from the seed
+// input: none
+// output: none (modifies the Race object in place)
+func (race *Race) Restart() {
+	race.status = RaceNotStarted
+	race.current_lap = 1
+	race.elapsed = 0
+	race.until_decision = 0
+	race.top_three = nil
+	race.classification = nil
+	race.best_sectors = nil
+	race.finished = 0
+	race.flag = FlagGreen
+	race.flag_timer = 0
+
+	race.decisions = nil
+	race.weather = new_weather(race.config)
+
+	// the racers keep their cars and lanes, everything else goes back to the start
+	for i, racer := range race.racers {
+		race.racers[i] = Racer{
+			ID:         racer.ID,
+			Name:       racer.Name,
+			Profile:    racer.Profile,
+			CPU:        racer.CPU,
+			MaxSpeed:   racer.MaxSpeed,
+			Lane:       racer.Lane,
+			Grid:       racer.Grid,
+			Status:     StatusWaiting,
+			CurrentLap: 1,
+			Tyre:       race.starting_tyre(),
+		}
+	}
+}
+
+// func RemoveRacer: takes a racer out of the race
+// input: the racer's id
+// output: the podium events if the race is complete once the racer is gone, or an error if
+// there is no racer with that id
+func (race *Race) RemoveRacer(id string) ([]Event, error) {
+	for i, racer := range race.racers {
+		if racer.ID == id {
+			race.racers = append(race.racers[:i], race.racers[i+1:]...)
+
+			// the race may be complete once the racer is gone
+			return race.update_status_and_lap(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("there is no racer with id %q", id)
+}
+
+// func TakeOver: hands the car of a CPU racer to a player, who carries on from where the car is
+// with the racer's place, laps and times under its own id and name
+// input: the CPU racer's id, and the id and name of the player's racer
+// output: a copy of the Racer object, or an error if there is no such CPU racer or its race is over
+func (race *Race) TakeOver(id string, player_id string, name string) (Racer, error) {
+	for i := range race.racers {
+		racer := &race.racers[i]
+		if racer.ID != id {
+			continue
+		}
+		if !racer.CPU {
+			return Racer{}, fmt.Errorf("%s is not driven by the CPU", racer.Name)
+		}
+		if race.status == RaceOngoing && racer.Status != StatusRunning {
+			return Racer{}, fmt.Errorf("%s is out of the race", racer.Name)
+		}
+
+		racer.ID = player_id
+		racer.Name = name
+		racer.CPU = false
+		return *racer, nil
+	}
+
+	return Racer{}, fmt.Errorf("there is no racer with id %q", id)
+}
+
+// func SetLaps: changes the number of laps of a race that nobody has finished yet, or of a race
+// that is over, which runs them once it restarts
+// input: the new number of laps
+// output: an error if the leader is already past that lap or someone has finished
+func (race *Race) SetLaps(laps int) error {
+	if race.Over() {
+		if laps < 1 {
+			return errors.New("the race needs at least 1 lap")
+		}
+		race.config.Laps = laps
+		return nil
+	}
+
+	if race.finished > 0 {
+		return errors.New("racers have already finished the race")
+	}
+	if laps < 1 || laps < race.current_lap {
+		return fmt.Errorf("the race needs at least %d laps, the leader is on lap %d", max(1, race.current_lap), race.current_lap)
+	}
+
+	race.config.Laps = laps
+	return nil
+}
@@ -0,0 +1,127 @@
+package sim
+
+import "fmt"
+
+// event kinds
+const (
+	EventLap         = "lap"
+	EventFinish      = "finish"
+	EventPodium      = "podium"
+	EventLaneChange  = "lane_change"
+	EventFlag        = "flag"
+	EventRejected    = "rejected"
+	EventCollision   = "collision"
+	EventRetired     = "retired"
+	EventPenalty     = "penalty"
+	EventPit         = "pit"
+	EventWeather     = "weather"
+	EventPhotoFinish = "photo_finish"
+	EventBlueFlag    = "blue_flag"
+	EventSector      = "sector"
+)
+
+// type Event: something that happened to a racer during a step
+type Event struct {
+	Kind  string
+	Racer string // id of the racer the event belongs to, empty for the whole race
+	Text  string // message meant for the racer's player
+	Flag  string // flag shown after the event, only set on flag events
+}
+
+// func lap_event: creates the event sent when a racer completes a lap
+// input: the racer's id, the lap it completed, the number of laps in the race and its Standing
+// output: an Event object
+func lap_event(id string, lap int, max_laps int, standing Standing) Event {
+	text := fmt.Sprintf("You have completed lap %d/%d. You are P%d", lap, max_laps, standing.Position)
+	if standing.Position > 1 {
+		text += fmt.Sprintf(", %.1fs behind the leader", standing.Gap)
+	}
+	return Event{Kind: EventLap, Racer: id, Text: text + " " + gained_text(standing.Gained) + "."}
+}
+
+// func gained_text: the positions a racer has gained or lost since the start as shown to players
+func gained_text(gained int) string {
+	if gained > 0 {
+		return fmt.Sprintf("(▲%d)", gained)
+	} else if gained < 0 {
+		return fmt.Sprintf("(▼%d)", -gained)
+	}
+	return "(=)"
+}
+
+// func finish_event: creates the event sent when a racer finishes the race
+// input: the racer's id
+// output: an Event object
+func finish_event(id string) Event {
+	return Event{Kind: EventFinish, Racer: id, Text: "You have finished the race!"}
+}
+
+// func podium_event: creates the event sent when a racer makes it to the podium
+// input: the racer's id and its podium position
+// output: an Event object
+func podium_event(id string, place int) Event {
+	return Event{Kind: EventPodium, Racer: id, Text: fmt.Sprintf("You have made it to the podium! Your position was: %d\nCongratulations!", place)}
+}
+
+// func lane_event: creates the event sent when a racer changes lanes
+// input: the racer's id, the lane it left and the lane it moved to
+// output: an Event object
+func lane_event(id string, from int, to int) Event {
+	return Event{Kind: EventLaneChange, Racer: id, Text: fmt.Sprintf("You have changed lanes from %d to %d.", from, to)}
+}
+
+// func flag_event: creates the event sent to every racer when the flag changes
+// input: the new flag and the message shown to the players
+// output: an Event object
+func flag_event(flag string, text string) Event {
+	return Event{Kind: EventFlag, Text: text, Flag: flag}
+}
+
+// func no_overtaking_event: creates the event sent when a player asks to change lanes under caution
+// input: the racer's id and the flag being shown
+// output: an Event object
+func no_overtaking_event(id string, flag string) Event {
+	return Event{Kind: EventRejected, Racer: id, Text: fmt.Sprintf("You cannot change lanes under the %s flag.", flag_name(flag))}
+}
+
+// func collision_event: creates the event sent to a racer whose car touched another one
+// input: the racer's id, the name of the other racer and the damage of the racer's car
+// output: an Event object
+func collision_event(id string, other string, damage float64) Event {
+	return Event{Kind: EventCollision, Racer: id, Text: fmt.Sprintf("💥 You collided with %s! Your car is %.0f%% damaged.", other, damage*100)}
+}
+
+// func retire_event: creates the event sent to a racer that has to retire
+// input: the racer's id
+// output: an Event object
+func retire_event(id string) Event {
+	return Event{Kind: EventRetired, Racer: id, Text: "Your car is too damaged to continue, you are out of the race (DNF)."}
+}
+
+// func penalty_event: creates the event sent to a racer penalized by the stewards
+// input: the racer's id and the stewards' Decision
+// output: an Event object
+func penalty_event(id string, decision Decision) Event {
+	return Event{Kind: EventPenalty, Racer: id, Text: "🧑‍⚖️ Stewards' decision: " + decision.String() + "."}
+}
+
+// func pit_event: creates the event sent to a racer driving through the pit lane
+// input: the racer's id and the message
+// output: an Event object
+func pit_event(id string, text string) Event {
+	return Event{Kind: EventPit, Racer: id, Text: text}
+}
+
+// func weather_event: creates the event sent to every racer when the weather changes or a forecast goes out
+// input: the message shown to the players
+// output: an Event object
+func weather_event(text string) Event {
+	return Event{Kind: EventWeather, Text: text}
+}
+
+// func blue_flag_event: creates the event sent to a racer that is about to be lapped
+// input: the racer's id and the name of the car lapping it
+// output: an Event object
+func blue_flag_event(id string, lapper string) Event {
+	return Event{Kind: EventBlueFlag, Racer: id, Text: fmt.Sprintf("🟦 Blue flag! %s is about to lap you, let them through.", lapper)}
+}
@@ -0,0 +1,219 @@
+package sim
+
+import (
+	"sort"
+	"time"
+)
+
+// flag states shown to the racers
+const (
+	FlagGreen     = "green"
+	FlagYellow    = "yellow"
+	FlagSafetyCar = "safety_car"
+	FlagRed       = "red"
+	FlagChequered = "chequered"
+)
+
+const (
+	yellow_duration     = 5 * time.Second  // caution shown before the safety car comes out
+	safety_car_duration = 20 * time.Second // shortest time the safety car stays on track
+	safety_car_spread   = 10               // extra random seconds the safety car may stay on track
+	yellow_speed_factor = 0.8              // fraction of their max speed racers may use under yellow
+	pace_speed          = 30.0             // speed of the pace car, in m/s
+	bunch_gap           = 15.0             // distance racers keep to the car ahead behind the pace car, in meters
+	crawl_speed         = 5.0              // slowest a racer closing up behind the pace car drives, so it never stops, in m/s
+	blue_flag_distance  = 30.0             // distance behind a racer within which a car lapping it brings out the blue flag, in meters
+	blue_flag_lift      = 0.9              // fraction of the lapping car's speed a CPU racer lifts to under the blue flag
+)
+
+// func Flag: tells the flag currently shown to the racers
+// input: none
+// output: one of the flag states
+func (race *Race) Flag() string {
+	return race.flag
+}
+
+// func DeploySafetyCar: shows the yellow flag for an incident, the safety car follows it
+// input: the reason shown to the racers
+// output: the flag event, if the flag changed
+func (race *Race) DeploySafetyCar(reason string) []Event {
+	if race.status != RaceOngoing || race.flag != FlagGreen {
+		return nil
+	}
+
+	race.flag = FlagYellow
+	race.flag_timer = yellow_duration
+	return []Event{flag_event(FlagYellow, "🟨 Yellow flag! "+reason+" No overtaking.")}
+}
+
+// func Suspend: stops the race under a red flag, no time passes until it is resumed
+// input: none
+// output: the flag event, if the flag changed
+func (race *Race) Suspend() []Event {
+	if race.status != RaceOngoing || race.flag == FlagRed {
+		return nil
+	}
+
+	race.flag_before_red = race.flag
+	race.flag = FlagRed
+	return []Event{flag_event(FlagRed, "🟥 Red flag! The race is suspended.")}
+}
+
+// func Resume: lifts the red flag and shows the flag that was out before it
+// input: none
+// output: the flag event, if the flag changed
+func (race *Race) Resume() []Event {
+	if race.status != RaceOngoing || race.flag != FlagRed {
+		return nil
+	}
+
+	race.flag = race.flag_before_red
+	return []Event{flag_event(race.flag, "The red flag is lifted, the race resumes under the "+flag_name(race.flag)+" flag.")}
+}
+
+// func update_flags: moves the caution periods forward and starts random incidents
+// input: none
+// output: the flag events
+func (race *Race) update_flags() []Event {
+	race.flag_timer -= decision_interval
+
+	switch race.flag {
+	case FlagGreen:
+		// there is a roll for an incident on every decision under green, unless incidents are turned off
+		if race.config.IncidentChance > 0 && race.rng.Float64() < race.config.IncidentChance {
+			return race.DeploySafetyCar("Debris on track.")
+		}
+
+	case FlagYellow:
+		if race.flag_timer <= 0 {
+			race.flag = FlagSafetyCar
+			race.flag_timer = safety_car_duration + time.Duration(race.rng.Intn(safety_car_spread+1))*time.Second
+			return []Event{flag_event(FlagSafetyCar, "🚨 Safety car deployed! Close up behind the pace car, no overtaking.")}
+		}
+
+	case FlagSafetyCar:
+		if race.flag_timer <= 0 {
+			race.flag = FlagGreen
+			return []Event{flag_event(FlagGreen, "🟢 The safety car is in, green flag! Racing resumes.")}
+		}
+	}
+
+	return nil
+}
+
+// func apply_flag_speeds: limits the racers' speeds under the yellow flag and the safety car
+// input: none
+// output: none (modifies the racers in place)
+func (race *Race) apply_flag_speeds() {
+	switch race.flag {
+	case FlagYellow:
+		for i := range race.racers {
+			racer := &race.racers[i]
+			if racer.Status == StatusRunning && racer.Speed > racer.top_speed()*yellow_speed_factor {
+				racer.Speed = racer.top_speed() * yellow_speed_factor
+			}
+		}
+
+	case FlagSafetyCar:
+		// the leader follows the pace car and every racer closes up to the car ahead of it
+		order := race.running_order()
+		for i, racer := range order {
+			if i == 0 {
+				racer.Speed = min(pace_speed, racer.top_speed())
+				continue
+			}
+
+			ahead := order[i-1]
+			gap := ahead.Distance - racer.Distance
+			racer.Speed = max(ahead.Speed+(gap-bunch_gap)/decision_interval.Seconds(), crawl_speed)
+			clamp_speed(racer)
+		}
+	}
+}
+
+// func running_order: lists the racers running on the track from the one furthest along the race,
+// the cars in the pit lane are not in the queue behind the pace car, cars level on distance are
+// ordered by their grid slot and then their id
+// input: none
+// output: pointers to the running racers
+func (race *Race) running_order() []*Racer {
+	order := []*Racer{}
+	for i := range race.racers {
+		if race.racers[i].Status == StatusRunning && !race.racers[i].InPit {
+			order = append(order, &race.racers[i])
+		}
+	}
+
+	sort.Slice(order, func(a, b int) bool {
+		if order[a].Distance != order[b].Distance {
+			return order[a].Distance > order[b].Distance
+		}
+		if order[a].Grid != order[b].Grid {
+			return order[a].Grid < order[b].Grid
+		}
+		return order[a].ID < order[b].ID
+	})
+	return order
+}
+
+// func update_blue_flag: shows the blue flag to a racer with a car about to lap it right behind
+// input: a pointer to a Racer object
+// output: the car lapping the racer, or nil if there is none, and the blue flag event
+func (race *Race) update_blue_flag(racer *Racer) (*Racer, []Event) {
+	lapper := race.lapping_car(racer)
+
+	// the racer is told once each time the flag comes out
+	shown := racer.BlueFlag
+	racer.BlueFlag = lapper != nil
+	if racer.BlueFlag && !shown {
+		return lapper, []Event{blue_flag_event(racer.ID, lapper.Name)}
+	}
+	return lapper, nil
+}
+
+// func lapping_car: finds the closest car right behind a racer on the track that is ahead
+// of it in the race, which means it is about to lap the racer
+// input: a pointer to a Racer object
+// output: a pointer to the lapping car, or nil if there is none
+func (race *Race) lapping_car(racer *Racer) *Racer {
+	// cars only lap each other while overtaking is allowed
+	if !race.overtaking_allowed() || racer.InPit {
+		return nil
+	}
+
+	var lapper *Racer
+	closest := 0.0
+	for i := range race.racers {
+		other := &race.racers[i]
+		if other == racer || other.Status != StatusRunning || other.InPit || other.Distance <= racer.Distance {
+			continue
+		}
+
+		// the track is a loop, a car about to cross the line is behind a car just past it
+		gap := racer.Position - other.Position
+		if gap < 0 {
+			gap += race.config.LapDistance
+		}
+
+		if gap <= blue_flag_distance && (lapper == nil || gap < closest) {
+			lapper, closest = other, gap
+		}
+	}
+
+	return lapper
+}
+
+// func overtaking_allowed: tells if racers may change lanes under the current flag
+// input: none
+// output: a boolean value
+func (race *Race) overtaking_allowed() bool {
+	return race.flag == FlagGreen || race.flag == FlagChequered
+}
+
+// func flag_name: the name of a flag as shown to players
+func flag_name(flag string) string {
+	if flag == FlagSafetyCar {
+		return "safety car"
+	}
+	return flag
+}
@@ -0,0 +1,47 @@
+package sim
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// races where a car closing up behind the safety car used to stop and never move again
+func TestSafetyCarRacesFinish(t *testing.T) {
+	cases := []struct {
+		seed   int64
+		others bool // collisions and slipstreams are on too
+	}{
+		{278, false},
+		{33, true},
+		{290, true},
+	}
+
+	for _, c := range cases {
+		cfg := DefaultConfig()
+		cfg.Seed = c.seed
+		cfg.IncidentChance = 0.1
+		if c.others {
+			cfg.CollisionChance = 0.3
+			cfg.SlipstreamDistance = 20
+		}
+
+		race := NewRace(cfg)
+		for i := 0; i < 12; i++ {
+			race.AddRacer(fmt.Sprintf("c%d", i), true)
+		}
+		race.Start()
+
+		// ten laps of 500 meters take a few minutes, an hour of race time means a car is stuck
+		for step := 0; step < 3600 && !race.Over(); step++ {
+			race.Step(time.Second, nil)
+		}
+		if !race.Complete() {
+			for _, racer := range race.Snapshot().Racers {
+				if racer.Status == StatusRunning {
+					t.Errorf("seed %d: %s is stuck on lap %d at %.1f m/s", c.seed, racer.Name, racer.CurrentLap, racer.Speed)
+				}
+			}
+		}
+	}
+}
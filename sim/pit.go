@@ -0,0 +1,90 @@
+package sim
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	pit_lane_length = 100.0 // the pit lane runs along the first meters of the lap
+	pit_speed_limit = 20.0  // speed limit in the pit lane, in m/s
+	pit_speed_grace = 0.5   // speed over the limit the stewards let go, in m/s
+	pit_box         = 50.0  // where the crews change the tyres along the pit lane
+)
+
+// func enter_pit: sends a racer that crossed the line into the pit lane if it asked to, the
+// speed limit applies from the line so the step length does not change how far it got
+// input: a pointer to the Racer object that just completed a lap and the race time when it crossed the line
+// output: the pit event, if the racer went in
+func (race *Race) enter_pit(racer *Racer, crossed time.Duration) []Event {
+	if !racer.pit_requested || racer.Status != StatusRunning {
+		return nil
+	}
+
+	racer.pit_requested = false
+	racer.InPit = true
+	racer.pit_speeding = false
+	limit_pit_speed(racer)
+	race.move_back(racer, (race.elapsed-crossed).Seconds()*racer.Speed)
+	return []Event{pit_event(racer.ID, "You are in the pit lane, keep under the speed limit.")}
+}
+
+// func update_pit: checks the speed of a racer in the pit lane and lets it out at the end of it
+// input: a pointer to a Racer object and the race time when the step started
+// output: the penalty and pit events
+func (race *Race) update_pit(racer *Racer, start time.Duration) []Event {
+	if !racer.InPit {
+		return nil
+	}
+
+	events := []Event{}
+
+	// only one speeding penalty for each visit to the pit lane
+	if racer.Speed > pit_speed_limit+pit_speed_grace && !racer.pit_speeding {
+		racer.pit_speeding = true
+		events = append(events, race.penalize(racer, OffencePitSpeeding, PenaltyTime, 5)...)
+	}
+
+	// the crew changes the tyres at the pit box, the racer stops on it when it reaches it
+	// during the step and stays still while they do
+	if racer.tyre_request != "" && racer.Position >= pit_box {
+		reached := max(race.crossing_time(racer, pit_box), start)
+		race.move_back(racer, pit_box)
+		racer.Tyre = racer.tyre_request
+		racer.tyre_request = ""
+		racer.hold_until = reached + tyre_change_time
+		events = append(events, pit_event(racer.ID, fmt.Sprintf("🛞 Your crew fits %s tyres.", racer.Tyre)))
+	}
+
+	if racer.Position >= pit_lane_length {
+		racer.InPit = false
+		if racer.DriveThrough {
+			racer.DriveThrough = false
+			events = append(events, pit_event(racer.ID, "You have served your drive-through penalty."))
+		} else {
+			events = append(events, pit_event(racer.ID, "You are out of the pit lane."))
+		}
+	}
+
+	return events
+}
+
+// func limit_pit_speed: keeps the CPU driven racers in the pit lane under the speed limit,
+// players have to keep under it themselves
+// input: a pointer to a Racer object
+// output: none (modifies the Racer object in place)
+func limit_pit_speed(racer *Racer) {
+	if racer.InPit && !racer.player_driven && racer.Speed > pit_speed_limit {
+		racer.Speed = pit_speed_limit
+	}
+}
+
+// func move_back: puts a racer back to a position on the lap it drove past during the step
+// input: a pointer to a Racer object and the position
+// output: none (modifies the Racer object in place)
+func (race *Race) move_back(racer *Racer, position float64) {
+	if position < racer.Position {
+		racer.Position = position
+		race.update_distance(racer)
+	}
+}
@@ -0,0 +1,154 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+// func run_race: runs a race with CPU racers until it is over
+// input: the race configuration, the number of racers and the time step
+// output: the classification, the number of tyre stops made and of safety cars sent out
+func run_race(cfg Config, racers int, dt time.Duration) ([]Racer, int, int) {
+	race := NewRace(cfg)
+	for i := 1; i <= racers; i++ {
+		race.AddRacer(fmt.Sprintf("CPU %d", i), true)
+	}
+	race.Start()
+
+	stops, safety_cars := 0, 0
+	for !race.Over() {
+		for _, event := range race.Step(dt, nil) {
+			if event.Kind == EventPit && strings.Contains(event.Text, "crew fits") {
+				stops++
+			}
+			if event.Kind == EventFlag && strings.Contains(event.Text, "Safety car deployed") {
+				safety_cars++
+			}
+		}
+	}
+	return race.Snapshot().Results, stops, safety_cars
+}
+
+// func compare_steps: runs a seed with every time step and checks they all classify the racers
+// the same way as the first one
+// input: the test, the race configuration, the number of racers and the time steps
+// output: the number of tyre stops made and of safety cars sent out with the first step
+func compare_steps(t *testing.T, cfg Config, racers int, steps []time.Duration) (int, int) {
+	want, stops, safety_cars := run_race(cfg, racers, steps[0])
+
+	for _, dt := range steps[1:] {
+		got, _, _ := run_race(cfg, racers, dt)
+		if len(got) != len(want) {
+			t.Fatalf("seed %d, step %s: %d racers classified, want %d", cfg.Seed, dt, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].ID != want[i].ID || got[i].Status != want[i].Status || got[i].Place != want[i].Place {
+				t.Errorf("seed %d, step %s: P%d is %s (%s), want %s (%s)", cfg.Seed, dt, i+1, got[i].Name, got[i].Status, want[i].Name, want[i].Status)
+			}
+			if math.Abs(got[i].FinishTime-want[i].FinishTime) > 0.001 {
+				t.Errorf("seed %d, step %s: %s finished at %.3fs, want %.3fs", cfg.Seed, dt, got[i].Name, got[i].FinishTime, want[i].FinishTime)
+			}
+		}
+	}
+
+	return stops, safety_cars
+}
+
+// the classification of a seed does not depend on the time step, tyre stops included
+func TestTyreStopsDoNotDependOnStep(t *testing.T) {
+	steps := []time.Duration{time.Second, 250 * time.Millisecond, 50 * time.Millisecond, 10 * time.Millisecond}
+
+	total_stops := 0
+	for seed := int64(1); seed <= 8; seed++ {
+		cfg := DefaultConfig()
+		cfg.Laps = 40
+		cfg.Seed = seed
+		cfg.Weather = WeatherWet
+		cfg.WeatherChanges = true
+
+		stops, _ := compare_steps(t, cfg, 4, steps)
+		total_stops += stops
+	}
+
+	if total_stops == 0 {
+		t.Fatal("no tyre stop was made, the races do not test them")
+	}
+}
+
+// the classification of a seed does not depend on the time step with incidents, collisions,
+// slipstreams and changing weather, racers queue behind the safety car and wait at the pit box
+func TestIncidentsDoNotDependOnStep(t *testing.T) {
+	steps := []time.Duration{time.Second, 50 * time.Millisecond}
+
+	total_stops, total_safety_cars := 0, 0
+	for _, weather := range []string{WeatherDry, WeatherWet} {
+		for seed := int64(100); seed < 140; seed++ {
+			cfg := DefaultConfig()
+			cfg.Seed = seed
+			cfg.Weather = weather
+			cfg.WeatherChanges = true
+			cfg.IncidentChance = 0.05
+			cfg.CollisionChance = 0.3
+			cfg.SlipstreamDistance = 20
+
+			stops, safety_cars := compare_steps(t, cfg, 6, steps)
+			total_stops += stops
+			total_safety_cars += safety_cars
+		}
+	}
+
+	if total_stops == 0 || total_safety_cars == 0 {
+		t.Fatalf("%d tyre stops and %d safety cars, the races do not test them", total_stops, total_safety_cars)
+	}
+}
+
+// func run_pit_visits: runs a short race with a player that goes through the pit lane on every
+// lap, at full throttle or lifting to the speed limit before the pit lane
+// input: whether the player lifts for the pit lane
+// output: the stewards' decisions
+func run_pit_visits(lift bool) []Decision {
+	cfg := DefaultConfig()
+	cfg.Laps = 3
+	cfg.Seed = 7
+	race := NewRace(cfg)
+	player := race.AddRacer("Player", false)
+	race.AddRacer("CPU 1", true)
+	race.Start()
+
+	for !race.Over() {
+		input := Input{Throttle: 1, Pit: true}
+		for _, racer := range race.Snapshot().Racers {
+			near_pit := racer.InPit || racer.Position > cfg.LapDistance-pit_lane_length
+			if racer.ID == player.ID && lift && near_pit {
+				input.Throttle = pit_speed_limit / racer.top_speed()
+			}
+		}
+		race.Step(100*time.Millisecond, map[string]Input{player.ID: input})
+	}
+	return race.Decisions()
+}
+
+// a player driving through the pit lane over the speed limit is penalized, once for each visit
+func TestPitLaneSpeeding(t *testing.T) {
+	speeding := 0
+	for _, decision := range run_pit_visits(false) {
+		if decision.Offence == OffencePitSpeeding {
+			speeding++
+			if decision.Penalty != PenaltyTime || decision.Seconds != 5 {
+				t.Errorf("%s got %s %.0f for speeding in the pit lane, want 5 seconds", decision.Racer, decision.Penalty, decision.Seconds)
+			}
+		}
+	}
+	if speeding != 2 {
+		t.Errorf("%d speeding penalties for 2 pit lane visits at full throttle, want 2", speeding)
+	}
+
+	for _, decision := range run_pit_visits(true) {
+		if decision.Offence == OffencePitSpeeding {
+			t.Errorf("%s was penalized for speeding while keeping to the pit lane limit", decision.Racer)
+		}
+	}
+}
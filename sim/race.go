@@ -0,0 +1,588 @@
+// Package sim contains the grand prix race model: the racers, the race state
+// and the rules used to move it forward. It does no networking or printing, so
+// the server, batch tools, tests and bots can all embed the same simulator.
+package sim
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// race statuses
+const (
+	RaceNotStarted = "not_started"
+	RaceOngoing    = "ongoing"
+	RaceComplete   = "complete"
+	RaceAborted    = "aborted"
+)
+
+// simulated time between two speed and overtaking decisions of the racers
+const decision_interval = time.Second
+
+// distance to a slower car ahead from which a CPU racer overtakes it, in meters
+const overtake_reach = 10.0
+
+const (
+	cpu_reaction_min    = 150 * time.Millisecond // quickest reaction of a CPU racer to the lights going out
+	cpu_reaction_spread = 250 * time.Millisecond // extra random reaction time of a CPU racer
+)
+
+// type Config: the settings used to create a race
+type Config struct {
+	Laps        int     // number of race laps
+	LapDistance float64 // length of a single lap in meters
+	Lanes       int     // number of lanes on the track
+	Seed        int64   // seed for the race's random number generator
+	Sectors     int     // number of timed sectors each lap is split into
+
+	IncidentChance  float64 // chance of a random incident bringing out the safety car on each second of racing
+	CollisionChance float64 // chance of two cars overlapping on the same lane touching on each second of racing
+
+	SlipstreamDistance float64 // distance behind another car on the same lane within which a car gets a slipstream, zero disables it
+
+	Weather         string // weather state at the start of the race, empty for dry
+	WeatherChanges  bool   // the weather changes during the race
+	WeatherSegments int    // number of segments of the lap that get wet and dry on their own
+}
+
+// func DefaultConfig: returns the settings the server used before they were configurable
+// input: none
+// output: a Config object seeded with the current time
+func DefaultConfig() Config {
+	return Config{
+		Laps:        10,
+		LapDistance: 500,
+		Lanes:       6,
+		Seed:        time.Now().UnixNano(),
+		Sectors:     3,
+
+		WeatherSegments: 4,
+	}
+}
+
+// type Race
+type Race struct {
+	config          Config
+	status          string
+	current_lap     int
+	elapsed         time.Duration // simulated time since the race started
+	until_decision  time.Duration // simulated time left until the racers decide again
+	lanes           []int
+	racers          []Racer
+	top_three       []Racer
+	classification  []Racer // every racer in finishing order once the race is complete
+	finished        int     // number of racers that have finished
+	flag            string
+	flag_before_red string        // flag to show again once a red flag is lifted
+	flag_timer      time.Duration // simulated time left in the current caution period
+	decisions       []Decision    // the stewards' log
+	best_sectors    []float64     // fastest time of the race in each sector, zero until someone completes it
+	weather         weather
+	next_id         int // number of racers that got an id from the race
+
+	// every random choice of the race comes from the seed, in the order the racers make them, a
+	// feature that is turned off draws no numbers so turning a feature on or adding a new one
+	// does not change the races of the seeds that do without it
+	rng *rand.Rand
+}
+
+// type Snapshot: a copy of the race state that is safe to read while the race keeps running
+type Snapshot struct {
+	Status      string
+	Flag        string
+	CurrentLap  int
+	MaxLaps     int
+	LapDistance float64
+	Elapsed     float64
+	Lanes       []int
+	Racers      []Racer
+	TopThree    []Racer
+	Results     []Racer    // every racer in finishing order once the race is complete
+	Standings   []Standing // the live classification
+	Decisions   []Decision
+	Weather     Weather
+}
+
+// func NewRace: creates a race that has not started yet
+// input: a Config object
+// output: a pointer to a Race object with no racers
+func NewRace(cfg Config) *Race {
+	race := &Race{}
+	race.config = cfg
+	race.status = RaceNotStarted
+	race.current_lap = 1
+	race.flag = FlagGreen
+	race.rng = rand.New(rand.NewSource(cfg.Seed))
+	race.weather = new_weather(cfg)
+
+	// set the lanes to a list of numbers from [1, cfg.Lanes]
+	race.lanes = make([]int, cfg.Lanes)
+	for i := range race.lanes {
+		race.lanes[i] = i + 1
+	}
+
+	return race
+}
+
+// func AddRacer: adds a racer with random stats to a race that has not started yet
+// input: the racer's name and whether it is driven by the CPU
+// output: a copy of the new Racer object
+func (race *Race) AddRacer(name string, cpu bool) Racer {
+	if cpu {
+		return race.AddRacerWithProfile(name, CPUProfile, true)
+	}
+	return race.AddRacerWithProfile(name, PlayerProfile, false)
+}
+
+// func AddRacerWithProfile: adds a racer driving a car of the given profile, the racer
+// gets an id of its own
+// input: the racer's name, its car Profile and whether it is driven by the CPU
+// output: a copy of the new Racer object
+func (race *Race) AddRacerWithProfile(name string, profile Profile, cpu bool) Racer {
+	race.next_id++
+	return race.AddRacerWithID(fmt.Sprintf("racer-%d", race.next_id), name, profile, cpu)
+}
+
+// func AddRacerWithID: adds a racer with a given id, like the id of the client driving it,
+// racers added to an ongoing race join it running from the start line
+// input: the racer's id, its name, its car Profile and whether it is driven by the CPU
+// output: a copy of the new Racer object
+func (race *Race) AddRacerWithID(id string, name string, profile Profile, cpu bool) Racer {
+	racer := Racer{}
+	racer.ID = id
+	racer.Name = name
+	racer.Profile = profile.Name
+	racer.CPU = cpu
+	racer.Speed = 0      // all cars start with a speed of 0 m/s
+	racer.Position = 0   // initial position is zero
+	racer.CurrentLap = 1 // initial lap is 1
+	racer.Tyre = race.starting_tyre()
+
+	// random max speed between [MinSpeed, MaxSpeed) meters per second
+	racer.MaxSpeed = race.rng.Float64()*(profile.MaxSpeed-profile.MinSpeed) + profile.MinSpeed
+
+	// assign a random lane to the racer from the available lanes
+	racer.Lane = race.lanes[race.rng.Intn(len(race.lanes))]
+
+	// set the racer status to waiting, or running if the race is already ongoing
+	racer.Status = StatusWaiting
+	if race.status == RaceOngoing {
+		racer.Status = StatusRunning
+		racer.lap_start = race.elapsed
+		racer.sector_start = race.elapsed
+	}
+
+	// racers line up on the grid in the order they join, late ones at the back
+	racer.Grid = len(race.racers) + 1
+
+	race.racers = append(race.racers, racer)
+	return racer
+}
+
+// func AddRacerInPit: adds a racer to an ongoing race, starting from the pit lane at the
+// beginning of a lap so it does not get in the way of the cars already racing
+// input: the racer's id, its name, its car Profile and whether it is driven by the CPU
+// output: a copy of the new Racer object, or an error if the race is not ongoing
+func (race *Race) AddRacerInPit(id string, name string, profile Profile, cpu bool) (Racer, error) {
+	if race.status != RaceOngoing {
+		return Racer{}, errors.New("the race is not ongoing")
+	}
+
+	race.AddRacerWithID(id, name, profile, cpu)
+	racer := &race.racers[len(race.racers)-1]
+	racer.InPit = true
+	limit_pit_speed(racer)
+	return *racer, nil
+}
+
+// func Start: sets the race as ongoing and every racer as running, each racer
+// reacting to the lights going out with a random CPU reaction time
+// input: none
+// output: none (modifies the Race object in place)
+func (race *Race) Start() {
+	race.StartWithReactions(nil)
+}
+
+// func StartWithReactions: sets the race as ongoing and every racer as running, racers
+// do not move until their reaction time to the lights going out has passed
+// input: the reaction times of the racers driven by players, keyed by racer id, the
+// other racers get a random CPU reaction time
+// output: none (modifies the Race object in place)
+func (race *Race) StartWithReactions(reactions map[string]time.Duration) {
+	race.status = RaceOngoing
+	race.current_lap = 1
+
+	for i := range race.racers {
+		racer := &race.racers[i]
+		racer.Status = StatusRunning
+		racer.Grid = i + 1
+
+		reaction, ok := reactions[racer.ID]
+		if !ok {
+			reaction = cpu_reaction_min + time.Duration(race.rng.Float64()*float64(cpu_reaction_spread))
+		}
+		racer.Reaction = reaction.Seconds()
+		racer.hold_until = reaction
+	}
+}
+
+// func Step: advances the race by dt of simulated time
+// input: the time step and the inputs of the racers driven by players, keyed by racer id
+// output: the events that happened during the step
+func (race *Race) Step(dt time.Duration, inputs map[string]Input) []Event {
+	// no time passes while the race is suspended under a red flag
+	if race.status != RaceOngoing || race.flag == FlagRed {
+		return nil
+	}
+
+	events := []Event{}
+
+	// players pick their own lane and ask for the pit lane as soon as they want to
+	for i := range race.racers {
+		racer := &race.racers[i]
+		_, racer.player_driven = inputs[racer.ID]
+		if input, ok := inputs[racer.ID]; ok && input.Pit {
+			racer.pit_requested = true
+			racer.tyre_request = input.Tyre
+		}
+		if input, ok := inputs[racer.ID]; ok && input.Lane != 0 && input.Lane != racer.Lane && racer.Status == StatusRunning {
+			if !race.overtaking_allowed() {
+				events = append(events, no_overtaking_event(racer.ID, race.flag))
+				continue
+			}
+			events = append(events, race.change_lane(racer, input.Lane)...)
+		}
+	}
+
+	// split the step at every decision so the random choices happen at the same race
+	// times whatever the step length is, which keeps the outcome of a seed the same
+	for dt > 0 {
+		if race.until_decision <= 0 {
+			events = append(events, race.decide(inputs)...)
+			race.until_decision += decision_interval
+		}
+
+		chunk := min(dt, race.until_decision)
+		events = append(events, race.advance(chunk, inputs)...)
+		race.until_decision -= chunk
+		dt -= chunk
+	}
+
+	// update the race status and current lap based on the racers' state
+	events = append(events, race.update_status_and_lap()...)
+
+	return events
+}
+
+// func decide: updates the flags and the speed of every running racer and lets the CPU racers overtake
+// input: the inputs of the racers driven by players, keyed by racer id
+// output: the flag and lane change events
+func (race *Race) decide(inputs map[string]Input) []Event {
+	events := race.update_flags()
+	events = append(events, race.update_weather()...)
+
+	for i := range race.racers {
+		// get the racer object by reference
+		racer := &race.racers[i]
+
+		// only racers that are running are updated
+		if racer.Status != StatusRunning {
+			continue
+		}
+
+		// follow the car ahead closely enough and it takes drag away
+		race.update_slipstream(racer)
+
+		// racers about to be lapped are shown the blue flag
+		lapper, blue_flag_events := race.update_blue_flag(racer)
+		events = append(events, blue_flag_events...)
+
+		if !racer.player_driven && lapper != nil {
+			// CPU driven racers under the blue flag move out of the way of the car lapping them
+			if lapper.Lane == racer.Lane {
+				events = append(events, race.change_lane(racer, race.adjacent_lane(racer))...)
+			}
+		} else if !racer.player_driven && race.overtaking_allowed() && race.can_overtake(racer) {
+			// CPU driven racers overtake whenever they catch a slower racer and the flag allows it
+			events = append(events, race.change_lane(racer, race.adjacent_lane(racer))...)
+		}
+
+		// CPU driven racers serve their drive-through on their next lap
+		if !racer.player_driven && racer.DriveThrough && !racer.InPit {
+			racer.pit_requested = true
+		}
+
+		// CPU driven racers change tyres when the track gets wet or dries up
+		if !racer.player_driven {
+			race.choose_tyres(racer)
+		}
+
+		// update the racer speed with the grip it has on the segment it is on
+		race.update_grip(racer)
+		update_racer_speed(racer, race.rng)
+
+		// the slipstream pulls the racer towards the car ahead
+		if racer.Slipstream > 0 {
+			racer.Speed += racer.Slipstream * slipstream_pull
+			clamp_speed(racer)
+		}
+
+		// CPU driven racers under the blue flag lift to let the car lapping them by
+		if !racer.player_driven && lapper != nil {
+			racer.Speed = min(racer.Speed, lapper.Speed*blue_flag_lift)
+		}
+	}
+
+	// slow the racers down under the yellow flag and the safety car, and the CPU driven
+	// racers down to the pit lane speed limit
+	race.apply_flag_speeds()
+	for i := range race.racers {
+		limit_pit_speed(&race.racers[i])
+	}
+
+	// cars that end up on top of each other may touch
+	events = append(events, race.check_collisions()...)
+
+	// the racers driven by the simulator use the throttle they need for the speed they chose
+	for i := range race.racers {
+		racer := &race.racers[i]
+		if racer.Status == StatusRunning && !racer.player_driven {
+			racer.Throttle = min(1, racer.Speed/racer.top_speed())
+			racer.Brake = 0
+		}
+	}
+
+	return events
+}
+
+// func advance: moves every running racer along the track
+// input: the time to move the racers for and the inputs of the racers driven by players
+// output: the lap, finish and podium events
+func (race *Race) advance(dt time.Duration, inputs map[string]Input) []Event {
+	seconds := dt.Seconds()
+	start := race.elapsed
+	race.elapsed += dt
+
+	events := []Event{}
+	crossings := []crossing{}
+
+	for i := range race.racers {
+		racer := &race.racers[i]
+		if racer.Status != StatusRunning {
+			continue
+		}
+
+		if input, has_input := inputs[racer.ID]; has_input {
+			apply_input(racer, input, seconds)
+		}
+
+		// update the racer position, racers do not move until they react to the start
+		// or while their crew changes their tyres
+		moving := seconds
+		if racer.hold_until > start {
+			moving = max(0, (race.elapsed - racer.hold_until).Seconds())
+		}
+		update_racer_position(racer, moving)
+		race.update_distance(racer)
+
+		// check the racers driving through the pit lane and time the sectors they complete
+		events = append(events, race.update_pit(racer, start)...)
+		events = append(events, race.check_sectors(racer)...)
+
+		// check if the racer position exceeds the lap distance
+		if racer.Position >= race.config.LapDistance {
+			crossings = append(crossings, crossing{racer, race.crossing_time(racer, race.config.LapDistance)})
+		}
+	}
+
+	// the racers that crossed the line during the step do it in the order they really crossed it
+	sort.SliceStable(crossings, func(a, b int) bool {
+		return crossings[a].time < crossings[b].time
+	})
+	for _, c := range crossings {
+		events = append(events, race.complete_lap(c.racer, c.time)...)
+	}
+
+	return events
+}
+
+// func update_distance: works out how far a racer got in the race from its lap and its position
+// on it, rather than adding up every step, so racers held on the same spot are level whatever
+// the step length
+// input: a pointer to a Racer object
+// output: none (modifies the Racer object in place)
+func (race *Race) update_distance(racer *Racer) {
+	racer.Distance = float64(racer.CurrentLap-1)*race.config.LapDistance + racer.Position
+}
+
+// func complete_lap: moves a racer onto its next lap and finishes it after the last one
+// input: a pointer to a Racer object and the race time when it crossed the line
+// output: the lap, finish and podium events of the racer
+func (race *Race) complete_lap(racer *Racer, crossed time.Duration) []Event {
+	// increment the lap by one and carry the distance past the line into the new lap
+	racer.CurrentLap++
+	racer.Position -= race.config.LapDistance
+
+	// record how long the last sector and the lap took and start timing the next one
+	sector_events := race.complete_sector(racer, crossed)
+	start_sectors(racer, crossed)
+	racer.LapTimes = append(racer.LapTimes, (crossed - racer.lap_start).Seconds())
+	racer.lap_start = crossed
+
+	standing, _ := standing_of(race.Standings(), racer.ID)
+	events := append(sector_events, lap_event(racer.ID, racer.CurrentLap-1, race.config.Laps, standing))
+
+	// check if the racer lap exceeds the max laps, once the leader has taken the chequered
+	// flag the lapped racers finish as they cross the line too
+	if racer.CurrentLap > race.config.Laps || race.flag == FlagChequered {
+		racer.Status = StatusFinished
+		racer.FinishTime = crossed.Seconds()
+		race.finished++
+		racer.Place = race.finished
+		events = append(events, finish_event(racer.ID))
+
+		// the first racer across the line takes the chequered flag, the rest finish as they cross it
+		if race.flag != FlagChequered {
+			race.flag = FlagChequered
+			events = append(events, flag_event(FlagChequered, "🏁 Chequered flag! "+racer.Name+" is the first across the line."))
+		}
+	} else {
+		events = append(events, race.enter_pit(racer, crossed)...)
+	}
+
+	// racers have a few laps to serve a drive-through
+	events = append(events, race.check_drive_through(racer)...)
+
+	return events
+}
+
+// func can_overtake: checks if a racer is catching a slower car ahead of it on the same lane,
+// or is close enough to slingshot out of the slipstream of the car ahead
+// input: a pointer to a Racer object
+// output: a boolean value indicating whether overtaking is possible or not
+func (race *Race) can_overtake(racer *Racer) bool {
+	// the car ahead is found on the track, whatever lap each car is on
+	ahead, gap := race.car_ahead(racer)
+	if ahead == nil {
+		return false
+	}
+
+	// a racer in a slipstream stays in the tow until it is close enough to pull out and pass
+	if racer.Slipstream > 0 {
+		return gap <= slingshot_gap
+	}
+
+	// check if the car ahead is slower than the racer and is within a certain distance
+	return ahead.Speed < racer.Speed && gap <= overtake_reach
+}
+
+// func adjacent_lane: picks a random lane next to the racer's current lane, free if possible
+// input: a pointer to a Racer object
+// output: the chosen lane, or zero if there is none
+func (race *Race) adjacent_lane(racer *Racer) int {
+	adjacent_lanes := []int{}
+	free_lanes := []int{}
+	for _, lane := range race.lanes {
+		if lane == racer.Lane-1 || lane == racer.Lane+1 {
+			adjacent_lanes = append(adjacent_lanes, lane)
+			if race.lane_free(racer, lane) {
+				free_lanes = append(free_lanes, lane)
+			}
+		}
+	}
+
+	// prefer the lanes where the racer does not end up on top of another car
+	if len(free_lanes) > 0 {
+		adjacent_lanes = free_lanes
+	}
+
+	if len(adjacent_lanes) == 0 {
+		return 0
+	}
+
+	return adjacent_lanes[race.rng.Intn(len(adjacent_lanes))]
+}
+
+// func change_lane: moves a racer to another lane if it exists on the track
+// input: a pointer to a Racer object and the lane to move to
+// output: the lane change event and the penalty events, if the racer moved
+func (race *Race) change_lane(racer *Racer, lane int) []Event {
+	if lane < 1 || lane > len(race.lanes) || lane == racer.Lane {
+		return nil
+	}
+
+	// the stewards look at the move before it happens
+	events := race.check_lane_change(racer, lane)
+
+	from := racer.Lane
+	racer.Lane = lane
+
+	return append([]Event{lane_event(racer.ID, from, lane)}, events...)
+}
+
+// func update_status_and_lap: updates the race status and current lap based on the racers' state
+// input: none
+// output: the podium events once the race is complete
+func (race *Race) update_status_and_lap() []Event {
+	max_lap := 1
+	done_racers := 0
+
+	for _, racer := range race.racers {
+		if racer.CurrentLap > max_lap {
+			max_lap = racer.CurrentLap
+		}
+
+		if racer.Status == StatusFinished || racer.Status == StatusRetired || racer.Status == StatusDisqualified {
+			done_racers++
+		}
+	}
+
+	// the race's current lap matches the car that is currently winning the race, the winner
+	// is past the last lap once it crosses the line
+	race.current_lap = min(max_lap, race.config.Laps)
+
+	// the race is complete once every racer has finished, retired or been disqualified
+	if done_racers == len(race.racers) && race.status == RaceOngoing {
+		race.status = RaceComplete
+		return race.classify()
+	}
+
+	return nil
+}
+
+// func Complete: tells if every racer has finished the race
+// input: none
+// output: a boolean value
+func (race *Race) Complete() bool {
+	return race.status == RaceComplete
+}
+
+// func Snapshot: copies the current race state
+// input: none
+// output: a Snapshot object that does not share memory with the race
+func (race *Race) Snapshot() Snapshot {
+	snapshot := Snapshot{}
+	snapshot.Status = race.status
+	snapshot.Flag = race.flag
+	snapshot.CurrentLap = race.current_lap
+	snapshot.MaxLaps = race.config.Laps
+	snapshot.LapDistance = race.config.LapDistance
+	snapshot.Elapsed = race.elapsed.Seconds()
+	snapshot.Lanes = append([]int(nil), race.lanes...)
+	snapshot.Racers = make([]Racer, len(race.racers))
+	for i, racer := range race.racers {
+		racer.LapTimes = append([]float64(nil), racer.LapTimes...)
+		racer.SectorTimes = append([]float64(nil), racer.SectorTimes...)
+		racer.BestSectors = append([]float64(nil), racer.BestSectors...)
+		snapshot.Racers[i] = racer
+	}
+	snapshot.TopThree = append([]Racer(nil), race.top_three...)
+	snapshot.Results = append([]Racer(nil), race.classification...)
+	snapshot.Standings = race.Standings()
+	snapshot.Decisions = race.Decisions()
+	snapshot.Weather = race.Weather()
+	return snapshot
+}
@@ -0,0 +1,168 @@
+package sim
+
+import (
+	"math/rand"
+	"time"
+)
+
+// racer statuses
+const (
+	StatusWaiting      = "waiting"
+	StatusRunning      = "running"
+	StatusFinished     = "finished"
+	StatusRetired      = "retired"      // did not finish (DNF)
+	StatusDisqualified = "disqualified" // excluded by the stewards (DSQ)
+)
+
+// type Racer
+type Racer struct {
+	ID           string // unique in the race, players' racers have the id of the client driving them
+	Name         string
+	Status       string
+	Profile      string
+	CPU          bool
+	Speed        float64
+	MaxSpeed     float64
+	Position     float64 // meters covered on the current lap
+	Distance     float64 // meters covered since the start of the race
+	Lane         int
+	CurrentLap   int
+	Damage       float64   // damage taken in collisions, between [0, 1]
+	Reaction     float64   // seconds the racer took to react to the lights going out
+	LapTimes     []float64 // seconds taken by each completed lap
+	SectorTimes  []float64 // seconds taken by each sector completed on the current lap
+	BestSectors  []float64 // the racer's fastest time in each sector, zero until it completes it
+	FinishTime   float64   // race time when the racer crossed the finish line, in seconds
+	PenaltyTime  float64   // seconds added to the racer's race time by the stewards
+	DriveThrough bool      // the racer has a drive-through penalty to serve
+	BlueFlag     bool      // a car about to lap the racer is right behind it
+	InPit        bool      // the racer is driving through the pit lane
+	Tyre         string    // the tyres the racer is driving on
+	Slipstream   float64   // strength of the slipstream the racer is in, between [0, 1]
+	Throttle     float64   // fraction of its top speed the racer is driving at, between [0, 1]
+	Brake        float64   // fraction of the braking force the racer's player applied on the last step, between [0, 1]
+	Grid         int       // position on the starting grid
+	Place        int       // position in the classification, zero until the race is complete and for disqualified racers
+
+	lap_start          time.Duration   // race time when the current lap started
+	sector             int             // sector of the lap the racer is in, from zero
+	sector_start       time.Duration   // race time when the current sector started
+	hold_until         time.Duration   // race time until which the racer stays still, at the start and on pit stops
+	lane_changes       []time.Duration // race times of the racer's recent lane changes
+	drive_through_laps int             // laps completed since the drive-through was given
+	pit_requested      bool            // the racer goes into the pit lane when it next crosses the line
+	pit_speeding       bool            // the racer has been penalized for speeding on this pit lane visit
+	tyre_request       string          // the tyres to fit on the next pit stop, empty to only drive through
+	grip_loss          float64         // fraction of the top speed lost to the wetness of the track
+	player_driven      bool            // the racer got a player's input on the last step
+}
+
+// type Profile: the kind of car a racer drives
+type Profile struct {
+	Name     string
+	MinSpeed float64 // lowest max speed a car of this profile can get, in m/s
+	MaxSpeed float64 // highest max speed a car of this profile can get, in m/s
+}
+
+// car profiles used by the server
+var (
+	PlayerProfile = Profile{"player", 55, 65}
+	CPUProfile    = Profile{"cpu", 50, 60}
+)
+
+// car classes the players can choose from when they join, every class has the same average top
+// speed so the choice is between a predictable car and a gamble
+var PlayerClasses = []Profile{
+	PlayerProfile,
+	{"steady", 59, 61},
+	{"wild", 50, 70},
+}
+
+// func PlayerClass: finds a car class by name, no name is the default player class
+// input: the class name
+// output: the class Profile and true, or false if there is no class with that name
+func PlayerClass(name string) (Profile, bool) {
+	if name == "" {
+		return PlayerProfile, true
+	}
+	for _, profile := range PlayerClasses {
+		if profile.Name == name {
+			return profile, true
+		}
+	}
+	return Profile{}, false
+}
+
+// type Input: the controls a player sends for its racer on a step
+type Input struct {
+	Throttle float64 // fraction of the max speed the player wants to reach, between [0, 1]
+	Brake    float64 // fraction of the braking force applied, between [0, 1]
+	Lane     int     // lane the player wants to move to, zero keeps the current lane
+	Pit      bool    // the player wants to go through the pit lane when it next crosses the line
+	Tyre     string  // tyres to fit when going through the pit lane, empty to keep the current ones
+}
+
+// deceleration of a racer braking at full force, in m/s²
+const brake_force = 20.0
+
+// func update_racer_speed: updates the speed of a racer given the race conditions
+// input: a pointer to a Racer object and the race's random number generator
+// output: none (modifies the Racer object in place)
+func update_racer_speed(racer *Racer, rng *rand.Rand) {
+	// if the racer is standing still, on the grid or anywhere else, accelerate quickly to its max speed
+	if racer.Speed == 0 {
+		// increase the speed by a random factor between [0.5, 1.0) of the max speed
+		racer.Speed += (rng.Float64() + 0.5) * racer.top_speed()
+	} else {
+		// otherwise, adjust the speed randomly by a small amount
+		// increase or decrease the speed by a random factor between [-0.1, 0.2) of the speed
+		racer.Speed += (rng.Float64()*0.3 - 0.1) * racer.Speed
+
+		// make sure the speed does not exceed the max speed or go below zero
+		clamp_speed(racer)
+	}
+}
+
+// func apply_input: limits a racer's speed to what its player asked for
+// input: a pointer to a Racer object, the player's Input and the time step in seconds
+// output: none (modifies the Racer object in place)
+func apply_input(racer *Racer, input Input, dt float64) {
+	racer.Throttle = input.Throttle
+	racer.Brake = input.Brake
+
+	if target := input.Throttle * racer.top_speed(); racer.Speed > target {
+		racer.Speed = target
+	}
+
+	// brakes lose their bite with the grip
+	racer.Speed -= input.Brake * brake_force * (1 - racer.grip_loss) * dt
+
+	clamp_speed(racer)
+}
+
+// func top_speed: the max speed a racer can reach with the damage its car has taken,
+// the grip it has and the slipstream it is in
+// input: none
+// output: the speed in m/s
+func (racer *Racer) top_speed() float64 {
+	return racer.MaxSpeed * (1 - racer.Damage*damage_speed_loss) * (1 - racer.grip_loss) * (1 + racer.Slipstream*slipstream_drag_bonus)
+}
+
+// func clamp_speed: keeps the speed of a racer between zero and its top speed
+// input: a pointer to a Racer object
+// output: none (modifies the Racer object in place)
+func clamp_speed(racer *Racer) {
+	if racer.Speed > racer.top_speed() {
+		racer.Speed = racer.top_speed()
+	} else if racer.Speed < 0 {
+		racer.Speed = 0
+	}
+}
+
+// func update_racer_position: updates the position of a racer based on its speed and time interval
+// input: a pointer to a Racer object and the time step in seconds
+// output: none (modifies the Racer object in place)
+func update_racer_position(racer *Racer, dt float64) {
+	// increase the position by the racer's current speed (in meters per second)
+	racer.Position += racer.Speed * dt
+}
@@ -0,0 +1,117 @@
+package sim
+
+import (
+	"fmt"
+	"time"
+)
+
+// sector time colours shown to the racers
+const (
+	SectorOverallBest  = "purple" // fastest time of the race in the sector
+	SectorPersonalBest = "green"  // racer's own fastest time in the sector
+	SectorSlower       = "yellow" // slower than the racer's own best
+)
+
+// func sector_count: the number of sectors each lap is split into, at least one
+func (race *Race) sector_count() int {
+	return max(1, race.config.Sectors)
+}
+
+// func check_sectors: times the sectors a racer completed while moving, the last sector of
+// the lap is timed when the racer crosses the line
+// input: a pointer to a Racer object
+// output: the sector events
+func (race *Race) check_sectors(racer *Racer) []Event {
+	events := []Event{}
+
+	for racer.sector < race.sector_count()-1 {
+		line := float64(racer.sector+1) * race.config.LapDistance / float64(race.sector_count())
+		if racer.Position < line {
+			break
+		}
+		events = append(events, race.complete_sector(racer, race.crossing_time(racer, line))...)
+	}
+
+	return events
+}
+
+// func complete_sector: records the time of the sector a racer just completed and compares it
+// with the racer's best and the best of the race
+// input: a pointer to a Racer object and the race time when it left the sector
+// output: the sector event
+func (race *Race) complete_sector(racer *Racer, crossed time.Duration) []Event {
+	if len(race.best_sectors) != race.sector_count() {
+		race.best_sectors = make([]float64, race.sector_count())
+	}
+	if len(racer.BestSectors) != race.sector_count() {
+		racer.BestSectors = make([]float64, race.sector_count())
+	}
+
+	sector := racer.sector
+	seconds := (crossed - racer.sector_start).Seconds()
+	racer.SectorTimes = append(racer.SectorTimes, seconds)
+	racer.sector++
+	racer.sector_start = crossed
+
+	// a zero best means nobody has completed the sector yet
+	colour := SectorSlower
+	if race.best_sectors[sector] == 0 || seconds < race.best_sectors[sector] {
+		colour = SectorOverallBest
+		race.best_sectors[sector] = seconds
+	} else if racer.BestSectors[sector] == 0 || seconds < racer.BestSectors[sector] {
+		colour = SectorPersonalBest
+	}
+	if racer.BestSectors[sector] == 0 || seconds < racer.BestSectors[sector] {
+		racer.BestSectors[sector] = seconds
+	}
+
+	return []Event{sector_event(racer.ID, sector+1, seconds, colour)}
+}
+
+// func start_sectors: starts timing the first sector of a racer's new lap
+// input: a pointer to a Racer object and the race time when the lap started
+// output: none (modifies the Racer object in place)
+func start_sectors(racer *Racer, started time.Duration) {
+	racer.sector = 0
+	racer.sector_start = started
+	racer.SectorTimes = nil
+}
+
+// func BestLap: the fastest lap of a racer
+// input: none
+// output: the lap time in seconds, zero if the racer has not completed a lap
+func (racer Racer) BestLap() float64 {
+	best := 0.0
+	for _, lap := range racer.LapTimes {
+		if best == 0 || lap < best {
+			best = lap
+		}
+	}
+	return best
+}
+
+// func TheoreticalLap: the lap the racer would have done putting its best sectors together
+// input: none
+// output: the lap time in seconds, zero until the racer has completed every sector
+func (racer Racer) TheoreticalLap() float64 {
+	total := 0.0
+	for _, best := range racer.BestSectors {
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+// func sector_event: creates the event sent to a racer when it completes a sector
+// input: the racer's id, the sector number, its time in seconds and its colour
+// output: an Event object
+func sector_event(id string, sector int, seconds float64, colour string) Event {
+	marks := map[string]string{
+		SectorOverallBest:  "🟪 fastest of the race",
+		SectorPersonalBest: "🟩 personal best",
+		SectorSlower:       "🟨",
+	}
+	return Event{Kind: EventSector, Racer: id, Text: fmt.Sprintf("⏱️ Sector %d: %.3fs %s", sector, seconds, marks[colour])}
+}
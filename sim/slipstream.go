@@ -0,0 +1,52 @@
+package sim
+
+const (
+	slipstream_drag_bonus = 0.05 // extra top speed of a car in a full slipstream, as a fraction of its top speed
+	slipstream_pull       = 2.0  // speed a car in a full slipstream gains on every decision, in m/s
+	slingshot_gap         = 8.0  // distance to the car ahead from which a CPU racer pulls out of the slipstream to overtake, in meters
+)
+
+// func update_slipstream: sets the strength of the slipstream a racer gets from the car ahead of it
+// on the same lane, the closer the car the less drag the racer has
+// input: a pointer to a Racer object
+// output: none (modifies the Racer object in place)
+func (race *Race) update_slipstream(racer *Racer) {
+	racer.Slipstream = 0
+
+	// there is no tow with slipstreams turned off, and a car in the pit lane has nobody to follow
+	if race.config.SlipstreamDistance <= 0 || racer.InPit {
+		return
+	}
+
+	if ahead, gap := race.car_ahead(racer); ahead != nil && gap < race.config.SlipstreamDistance {
+		racer.Slipstream = 1 - gap/race.config.SlipstreamDistance
+	}
+}
+
+// func car_ahead: finds the closest running car ahead of a racer on the same lane of the track,
+// cars in the pit lane are not on the track
+// input: a pointer to a Racer object
+// output: a pointer to the car ahead and the gap to it in meters, or nil if there is none
+func (race *Race) car_ahead(racer *Racer) (*Racer, float64) {
+	var ahead *Racer
+	closest := 0.0
+
+	for i := range race.racers {
+		other := &race.racers[i]
+		if other == racer || other.Status != StatusRunning || other.InPit || other.Lane != racer.Lane {
+			continue
+		}
+
+		// the track is a loop, a car just past the line is ahead of a car about to cross it
+		gap := other.Position - racer.Position
+		if gap <= 0 {
+			gap += race.config.LapDistance
+		}
+
+		if ahead == nil || gap < closest {
+			ahead, closest = other, gap
+		}
+	}
+
+	return ahead, closest
+}
@@ -0,0 +1,123 @@
+package sim
+
+import "sort"
+
+// type Standing: the place of a racer in the live classification
+type Standing struct {
+	Position int
+	ID       string
+	Name     string
+	Status   string
+	Laps     int     // laps completed
+	Distance float64 // meters covered since the start
+	Gap      float64 // seconds behind the leader
+	Interval float64 // seconds behind the car ahead
+	LapsDown int     // whole laps behind the leader
+	Grid     int     // position on the starting grid
+	Gained   int     // positions gained since the start, negative when lost
+}
+
+// func Standings: ranks the racers as they are now, by laps completed and then by distance,
+// racers out of the race come last and a complete race keeps its final classification
+// input: none
+// output: the standings from the leader backwards
+func (race *Race) Standings() []Standing {
+	order := []*Racer{}
+	for i := range race.racers {
+		order = append(order, &race.racers[i])
+	}
+
+	if race.status == RaceComplete {
+		sort.SliceStable(order, func(a, b int) bool {
+			return race.classified_ahead(order[a], order[b])
+		})
+	} else {
+		sort.SliceStable(order, func(a, b int) bool {
+			return race.running_ahead(order[a], order[b])
+		})
+	}
+
+	standings := []Standing{}
+	for i, racer := range order {
+		standing := Standing{
+			Position: i + 1,
+			ID:       racer.ID,
+			Name:     racer.Name,
+			Status:   racer.Status,
+			Laps:     racer.CurrentLap - 1,
+			Distance: racer.Distance,
+			Grid:     racer.Grid,
+			Gained:   racer.Grid - (i + 1),
+		}
+
+		// the gaps only mean something for the racers still in the race
+		if i > 0 && in_race(racer) {
+			standing.Gap = race.time_gap(order[0], racer)
+			standing.Interval = race.time_gap(order[i-1], racer)
+			standing.LapsDown = int((order[0].Distance - standing.Distance) / race.config.LapDistance)
+		}
+
+		standings = append(standings, standing)
+	}
+
+	return standings
+}
+
+// func running_ahead: tells if a racer is ahead of another one on the road
+// input: pointers to the two Racer objects
+// output: a boolean value
+func (race *Race) running_ahead(a *Racer, b *Racer) bool {
+	// the racers out of the race are ranked after the others like in the final classification
+	if in_race(a) != in_race(b) {
+		return in_race(a)
+	}
+	if !in_race(a) {
+		return race.classified_ahead(a, b)
+	}
+
+	if a.CurrentLap != b.CurrentLap {
+		return a.CurrentLap > b.CurrentLap
+	}
+
+	// a racer that has finished crossed the line before the ones still on the same lap
+	if (a.Status == StatusFinished) != (b.Status == StatusFinished) {
+		return a.Status == StatusFinished
+	}
+	if a.Status == StatusFinished {
+		return a.FinishTime < b.FinishTime
+	}
+	return a.Position > b.Position
+}
+
+// func time_gap: estimates how many seconds a racer is behind another one, from the
+// finishing times when both have finished or from the racer's average speed otherwise
+// input: pointers to the Racer objects ahead and behind
+// output: the gap in seconds
+func (race *Race) time_gap(ahead *Racer, behind *Racer) float64 {
+	if ahead.Status == StatusFinished && behind.Status == StatusFinished {
+		return behind.FinishTime - ahead.FinishTime
+	}
+
+	average_speed := behind.Distance / race.elapsed.Seconds()
+	if race.elapsed <= 0 || average_speed <= 0 {
+		return 0
+	}
+	return (ahead.Distance - behind.Distance) / average_speed
+}
+
+// func in_race: tells if a racer is running or has finished, rather than retired or disqualified
+func in_race(racer *Racer) bool {
+	return racer.Status == StatusRunning || racer.Status == StatusFinished || racer.Status == StatusWaiting
+}
+
+// func standing_of: finds the standing of a racer
+// input: the standings and the racer's id
+// output: the Standing object, and false if the racer is not in the standings
+func standing_of(standings []Standing, id string) (Standing, bool) {
+	for _, standing := range standings {
+		if standing.ID == id {
+			return standing, true
+		}
+	}
+	return Standing{}, false
+}
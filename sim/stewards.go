@@ -0,0 +1,157 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// offences the stewards look for
+const (
+	OffenceBlocking     = "blocking"
+	OffenceUnsafeLane   = "unsafe lane change"
+	OffenceJumpStart    = "jump start"
+	OffencePitSpeeding  = "pit lane speeding"
+	OffenceDriveThrough = "drive-through not served"
+)
+
+// penalties the stewards can give
+const (
+	PenaltyTime         = "time"
+	PenaltyDriveThrough = "drive-through"
+	PenaltyDisqualified = "disqualification"
+)
+
+const (
+	blocking_changes     = 3                // lane changes within the blocking window that count as blocking
+	blocking_window      = 10 * time.Second // race time in which repeated lane changes count as blocking
+	drive_through_laps   = 3                // laps a racer has to serve a drive-through before being disqualified
+	drive_through_finish = 20.0             // seconds added to racers that finish with a drive-through to serve
+)
+
+// type Decision: a penalty given by the stewards
+type Decision struct {
+	Time    float64 // race time of the decision, in seconds
+	Racer   string
+	Offence string
+	Penalty string
+	Seconds float64 // seconds added to the racer's race time, only for time penalties
+}
+
+// func String: the decision as written in the stewards' log
+func (decision Decision) String() string {
+	penalty := decision.Penalty + " penalty"
+	switch decision.Penalty {
+	case PenaltyTime:
+		penalty = fmt.Sprintf("%.0f second penalty", decision.Seconds)
+	case PenaltyDisqualified:
+		penalty = "disqualified"
+	}
+	return fmt.Sprintf("%s: %s, %s", decision.Racer, decision.Offence, penalty)
+}
+
+// func PenalizeJumpStart: gives a drive-through to a racer that moved before the start
+// input: the racer's id
+// output: the penalty event, or nothing if there is no such racer
+func (race *Race) PenalizeJumpStart(id string) []Event {
+	for i := range race.racers {
+		if race.racers[i].ID == id {
+			return race.penalize(&race.racers[i], OffenceJumpStart, PenaltyDriveThrough, 0)
+		}
+	}
+	return nil
+}
+
+// func penalize: records a stewards' decision and applies it to the racer
+// input: a pointer to the penalized Racer, the offence, the penalty and the seconds of a time penalty
+// output: the penalty event
+func (race *Race) penalize(racer *Racer, offence string, penalty string, seconds float64) []Event {
+	decision := Decision{race.elapsed.Seconds(), racer.Name, offence, penalty, seconds}
+	race.decisions = append(race.decisions, decision)
+
+	switch penalty {
+	case PenaltyTime:
+		racer.PenaltyTime += seconds
+	case PenaltyDriveThrough:
+		racer.DriveThrough = true
+		racer.drive_through_laps = 0
+	case PenaltyDisqualified:
+		racer.Status = StatusDisqualified
+		racer.Speed = 0
+		racer.DriveThrough = false
+		racer.InPit = false
+	}
+
+	return []Event{penalty_event(racer.ID, decision)}
+}
+
+// func check_lane_change: looks for blocking and unsafe moves when a racer changes lanes
+// input: a pointer to the Racer object that is about to move and the lane it moves to
+// output: the penalty events
+func (race *Race) check_lane_change(racer *Racer, lane int) []Event {
+	events := []Event{}
+
+	// moving onto a car that is already there is unsafe
+	if !race.lane_free(racer, lane) {
+		events = append(events, race.penalize(racer, OffenceUnsafeLane, PenaltyTime, 5)...)
+	}
+
+	// changing lanes again and again to keep others behind is blocking
+	recent := []time.Duration{}
+	for _, at := range racer.lane_changes {
+		if race.elapsed-at < blocking_window {
+			recent = append(recent, at)
+		}
+	}
+	racer.lane_changes = append(recent, race.elapsed)
+	if len(racer.lane_changes) >= blocking_changes {
+		racer.lane_changes = nil
+		events = append(events, race.penalize(racer, OffenceBlocking, PenaltyTime, 10)...)
+	}
+
+	return events
+}
+
+// func lane_free: tells if a racer can move to a lane without ending up on top of another car
+// input: a pointer to a Racer object and the lane
+// output: a boolean value
+func (race *Race) lane_free(racer *Racer, lane int) bool {
+	for _, other := range race.racers {
+		if other.ID == racer.ID || other.Status != StatusRunning || other.Lane != lane {
+			continue
+		}
+		if math.Abs(other.Position-racer.Position) < car_length {
+			return false
+		}
+	}
+	return true
+}
+
+// func check_drive_through: counts the laps of a racer that has a drive-through to serve
+// input: a pointer to the Racer object that just completed a lap
+// output: the penalty events
+func (race *Race) check_drive_through(racer *Racer) []Event {
+	if !racer.DriveThrough || racer.InPit {
+		return nil
+	}
+
+	// racers that finish before serving it get time added instead
+	if racer.Status == StatusFinished {
+		racer.DriveThrough = false
+		racer.PenaltyTime += drive_through_finish
+		return nil
+	}
+
+	racer.drive_through_laps++
+	if racer.drive_through_laps >= drive_through_laps {
+		return race.penalize(racer, OffenceDriveThrough, PenaltyDisqualified, 0)
+	}
+	return nil
+}
+
+// func Decisions: the stewards' log
+// input: none
+// output: a copy of every decision taken so far
+func (race *Race) Decisions() []Decision {
+	return append([]Decision(nil), race.decisions...)
+}
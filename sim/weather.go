@@ -0,0 +1,286 @@
+package sim
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// weather states shown to the racers
+const (
+	WeatherDry      = "dry"
+	WeatherDamp     = "damp"
+	WeatherWet      = "wet"
+	WeatherChanging = "changing" // the track is drying or getting wetter
+)
+
+// tyres a racer can drive on
+const (
+	TyreSlick = "slick"
+	TyreWet   = "wet"
+)
+
+const (
+	damp_wetness = 0.2 // wetness from which a segment of the track is damp
+	wet_wetness  = 0.6 // wetness from which a segment of the track is wet
+
+	weather_change_min    = 90 * time.Second // shortest time between two weather changes
+	weather_change_spread = 120              // extra random seconds between two weather changes
+	forecast_horizon      = 60 * time.Second // how long before a weather change the forecast goes out
+	wetness_rate_min      = 0.01             // slowest change of a segment's wetness, per second
+	wetness_rate_spread   = 0.02             // extra random change of a segment's wetness, per second
+	weather_seed_salt     = 0x5ea7e7         // keeps the weather's random numbers apart from the race's
+
+	slick_wet_grip_loss = 0.5  // grip slicks lose on a fully wet track
+	wet_tyre_dry_grip   = 0.88 // grip of wet tyres on a dry track
+	wet_tyre_wet_grip   = 0.96 // grip of wet tyres on a fully wet track
+	wet_tyre_switch     = 0.3  // track wetness from which CPU racers change to wet tyres
+	slick_tyre_switch   = 0.15 // track wetness under which CPU racers change back to slicks
+	tyre_change_time    = 3 * time.Second
+)
+
+// type Weather: the weather on the track as shown to the racers
+type Weather struct {
+	State    string    // one of the weather states
+	Wetness  float64   // average wetness of the track, between [0, 1]
+	Segments []float64 // wetness of each segment of the lap, between [0, 1]
+	Forecast string    // the forecast of the next weather change, empty if none is due soon
+}
+
+// type weather: the weather of a race and the plan of its changes
+type weather struct {
+	segments    []float64     // wetness of each segment of the lap
+	rates       []float64     // change of each segment's wetness per second
+	target      float64       // wetness the segments are heading to
+	next_change time.Duration // race time of the next weather change, zero if the weather does not change
+	next_target float64       // wetness the track heads to on the next weather change
+	forecast    string        // forecast sent for the next weather change
+	state       string        // last state announced to the racers
+	rng         *rand.Rand    // the weather's own random numbers, so the racers' choices do not change it
+}
+
+// func new_weather: creates the weather at the start of a race
+// input: a Config object
+// output: a weather object with its first change planned, if the weather changes
+func new_weather(cfg Config) weather {
+	w := weather{}
+	w.rng = rand.New(rand.NewSource(cfg.Seed ^ weather_seed_salt))
+	w.target = state_wetness(cfg.Weather)
+	w.segments = make([]float64, max(1, cfg.WeatherSegments))
+	w.rates = make([]float64, len(w.segments))
+	for i := range w.segments {
+		w.segments[i] = w.target
+	}
+	w.state = w.current_state()
+
+	if cfg.WeatherChanges {
+		w.plan_change(0)
+	}
+	return w
+}
+
+// func plan_change: picks when the weather changes next and how wet the track gets
+// input: the current race time
+// output: none (modifies the weather object in place)
+func (w *weather) plan_change(now time.Duration) {
+	w.next_change = now + weather_change_min + time.Duration(w.rng.Intn(weather_change_spread+1))*time.Second
+
+	// the track heads to one of the other states
+	levels := []float64{}
+	for _, state := range []string{WeatherDry, WeatherDamp, WeatherWet} {
+		if level := state_wetness(state); level != w.target {
+			levels = append(levels, level)
+		}
+	}
+	w.next_target = levels[w.rng.Intn(len(levels))]
+	w.forecast = ""
+}
+
+// func update_weather: moves the weather forward, gives the forecasts and starts the planned changes
+// input: none
+// output: the weather events
+func (race *Race) update_weather() []Event {
+	w := &race.weather
+	events := []Event{}
+
+	if w.next_change > 0 {
+		// the forecast goes out once the change is close
+		if w.forecast == "" && w.next_change-race.elapsed <= forecast_horizon {
+			w.forecast = forecast_text(w.target, w.next_target, w.next_change-race.elapsed)
+			events = append(events, weather_event("📻 Forecast: "+w.forecast+"."))
+		}
+
+		// every segment of the track changes at its own rate
+		if race.elapsed >= w.next_change {
+			w.target = w.next_target
+			for i := range w.rates {
+				w.rates[i] = wetness_rate_min + w.rng.Float64()*wetness_rate_spread
+			}
+			w.plan_change(race.elapsed)
+		}
+	}
+
+	for i, wetness := range w.segments {
+		step := w.rates[i] * decision_interval.Seconds()
+		if wetness < w.target {
+			w.segments[i] = min(w.target, wetness+step)
+		} else if wetness > w.target {
+			w.segments[i] = max(w.target, wetness-step)
+		}
+	}
+
+	// tell the racers when the track starts or stops changing
+	if state := w.current_state(); state != w.state {
+		w.state = state
+		events = append(events, weather_event(weather_text(state, w.target)))
+	}
+
+	return events
+}
+
+// func update_grip: sets how much of its top speed a racer loses to the wetness of the
+// segment it is on with the tyres it has
+// input: a pointer to a Racer object
+// output: none (modifies the Racer object in place)
+func (race *Race) update_grip(racer *Racer) {
+	segments := race.weather.segments
+	segment := int(racer.Position / race.config.LapDistance * float64(len(segments)))
+	segment = min(max(segment, 0), len(segments)-1)
+
+	racer.grip_loss = 1 - tyre_grip(racer.Tyre, segments[segment])
+}
+
+// func choose_tyres: CPU driven racers pit for the tyres that suit the track
+// input: a pointer to a Racer object
+// output: none (modifies the Racer object in place)
+func (race *Race) choose_tyres(racer *Racer) {
+	if racer.InPit || racer.tyre_request != "" {
+		return
+	}
+
+	wetness := race.weather.wetness()
+	if racer.Tyre == TyreSlick && wetness > wet_tyre_switch {
+		racer.tyre_request = TyreWet
+		racer.pit_requested = true
+	} else if racer.Tyre == TyreWet && wetness < slick_tyre_switch {
+		racer.tyre_request = TyreSlick
+		racer.pit_requested = true
+	}
+}
+
+// func RequestPit: makes a racer go into the pit lane when it next crosses the line
+// input: the racer's id and the tyres to fit, empty to only drive through
+// output: an error if there is no running racer with that id or the tyres do not exist
+func (race *Race) RequestPit(id string, tyre string) error {
+	if tyre != "" && tyre != TyreSlick && tyre != TyreWet {
+		return fmt.Errorf("there are no %q tyres, use %s or %s", tyre, TyreSlick, TyreWet)
+	}
+
+	for i := range race.racers {
+		racer := &race.racers[i]
+		if racer.ID == id && racer.Status == StatusRunning {
+			racer.pit_requested = true
+			racer.tyre_request = tyre
+			return nil
+		}
+	}
+
+	return fmt.Errorf("there is no running racer with id %q", id)
+}
+
+// func Weather: copies the weather currently on the track
+// input: none
+// output: a Weather object
+func (race *Race) Weather() Weather {
+	w := race.weather
+	return Weather{
+		State:    w.current_state(),
+		Wetness:  w.wetness(),
+		Segments: append([]float64(nil), w.segments...),
+		Forecast: w.forecast,
+	}
+}
+
+// func starting_tyre: the tyres racers start on, wets if the track is wet enough
+func (race *Race) starting_tyre() string {
+	if race.weather.wetness() > wet_tyre_switch {
+		return TyreWet
+	}
+	return TyreSlick
+}
+
+// func wetness: the average wetness of the track
+func (w weather) wetness() float64 {
+	sum := 0.0
+	for _, wetness := range w.segments {
+		sum += wetness
+	}
+	return sum / float64(len(w.segments))
+}
+
+// func current_state: the state of the track, changing until every segment reaches its target
+func (w weather) current_state() string {
+	for _, wetness := range w.segments {
+		if wetness != w.target {
+			return WeatherChanging
+		}
+	}
+	return wetness_state(w.target)
+}
+
+// func tyre_grip: fraction of the top speed a car keeps on a segment of the track
+// input: the car's tyres and the wetness of the segment
+// output: the grip, between [0, 1]
+func tyre_grip(tyre string, wetness float64) float64 {
+	if tyre == TyreWet {
+		return wet_tyre_dry_grip + (wet_tyre_wet_grip-wet_tyre_dry_grip)*wetness
+	}
+	return 1 - slick_wet_grip_loss*wetness
+}
+
+// func state_wetness: the wetness the track settles at in a weather state
+func state_wetness(state string) float64 {
+	switch state {
+	case WeatherDamp:
+		return 0.4
+	case WeatherWet:
+		return 0.9
+	}
+	return 0
+}
+
+// func wetness_state: the weather state of a wetness level
+func wetness_state(wetness float64) string {
+	if wetness >= wet_wetness {
+		return WeatherWet
+	} else if wetness >= damp_wetness {
+		return WeatherDamp
+	}
+	return WeatherDry
+}
+
+// func forecast_text: the forecast of a weather change as shown to the racers
+// input: the current and next target wetness and the time until the change
+// output: the forecast
+func forecast_text(from float64, to float64, in time.Duration) string {
+	change := "drier weather"
+	if to > from {
+		change = "rain"
+	}
+	return fmt.Sprintf("%s expected in about %.0f seconds, %s conditions to follow", change, in.Seconds(), wetness_state(to))
+}
+
+// func weather_text: the message sent when the weather state changes
+// input: the new state and the wetness the track is heading to
+// output: the message
+func weather_text(state string, target float64) string {
+	switch state {
+	case WeatherChanging:
+		return fmt.Sprintf("🌦️ The weather is changing, the track is heading to %s conditions.", wetness_state(target))
+	case WeatherWet:
+		return "🌧️ The track is wet, slicks have little grip."
+	case WeatherDamp:
+		return "🌥️ The track is damp."
+	}
+	return "☀️ The track is dry."
+}
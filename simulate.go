@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"racer/sim"
+)
+
+var (
+	races      = flag.Int("races", 1000, "number of races to simulate")
+	workers    = flag.Int("workers", runtime.NumCPU(), "number of races simulated at the same time")
+	lapNumber  = flag.Int("lapNumber", 10, "number of race laps")
+	incidents  = flag.Float64("incidentChance", 0, "chance of an incident bringing out the safety car on each second of racing")
+	crashes    = flag.Float64("collisionChance", 0, "chance of two cars overlapping on the same lane touching on each second of racing")
+	slipstream = flag.Float64("slipstream", 0, "distance behind another car on the same lane within which a car gets a slipstream, in meters, 0 disables it")
+	weather    = flag.String("weather", "dry", "weather at the start of each race: dry, damp or wet")
+	rain       = flag.Bool("weatherChanges", false, "let the weather change during the races")
+	seed       = flag.Int64("seed", time.Now().UnixNano(), "seed of the first race")
+	profiles   = flag.String("profiles", "player:55:65:1,cpu:50:60:3", "comma separated car profiles as name:minSpeed:maxSpeed:count")
+	csvPath    = flag.String("csv", "", "file to write the statistics to as CSV, - for stdout")
+)
+
+// func parse_entries: reads the car profiles given in the -profiles flag
+// input: the flag value
+// output: the list of entries, or an error if a profile is malformed
+func parse_entries(value string) ([]sim.Entry, error) {
+	entries := []sim.Entry{}
+
+	for _, field := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("profile %q should be name:minSpeed:maxSpeed:count", field)
+		}
+
+		min_speed, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %v", field, err)
+		}
+		max_speed, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %v", field, err)
+		}
+		count, err := strconv.Atoi(parts[3])
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %v", field, err)
+		}
+		if min_speed <= 0 || max_speed < min_speed || count < 1 {
+			return nil, fmt.Errorf("profile %q: speeds must be positive with min <= max and count at least 1", field)
+		}
+
+		entries = append(entries, sim.Entry{Profile: sim.Profile{Name: parts[0], MinSpeed: min_speed, MaxSpeed: max_speed}, Count: count})
+	}
+
+	return entries, nil
+}
+
+// func write_table: prints the statistics as a human readable table
+// input: the output writer and the statistics of each profile
+// output: none
+func write_table(w io.Writer, stats []sim.ProfileStats) {
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "profile\tstarts\twin %\tpodium %\tdnf %\tavg pos\tlaps\tlap mean\tlap sd\tlap min\tlap p50\tlap p90\tlap max\t")
+	for _, s := range stats {
+		fmt.Fprintf(table, "%s\t%d\t%.1f\t%.1f\t%.1f\t%.2f\t%d\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t%.2f\t\n",
+			s.Profile, s.Starts, s.WinRate()*100, s.PodiumRate()*100, s.RetirementRate()*100, s.AveragePosition, s.LapTimes.Count,
+			s.LapTimes.Mean, s.LapTimes.StdDev, s.LapTimes.Min, s.LapTimes.P50, s.LapTimes.P90, s.LapTimes.Max)
+	}
+	table.Flush()
+}
+
+// func write_csv: writes the statistics as CSV with a header row
+// input: the output writer and the statistics of each profile
+// output: an error if the rows could not be written
+func write_csv(w io.Writer, stats []sim.ProfileStats) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"profile", "starts", "wins", "podiums", "retirements", "win_rate", "podium_rate", "retirement_rate", "avg_position",
+		"laps", "lap_mean", "lap_stddev", "lap_min", "lap_p50", "lap_p90", "lap_max"})
+
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', 4, 64) }
+	for _, s := range stats {
+		out.Write([]string{s.Profile, strconv.Itoa(s.Starts), strconv.Itoa(s.Wins), strconv.Itoa(s.Podiums),
+			strconv.Itoa(s.Retirements), format(s.WinRate()), format(s.PodiumRate()), format(s.RetirementRate()), format(s.AveragePosition), strconv.Itoa(s.LapTimes.Count),
+			format(s.LapTimes.Mean), format(s.LapTimes.StdDev), format(s.LapTimes.Min), format(s.LapTimes.P50),
+			format(s.LapTimes.P90), format(s.LapTimes.Max)})
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// simulator's main function
+func main() {
+	flag.Parse()
+
+	entries, err := parse_entries(*profiles)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *slipstream < 0 {
+		log.Fatal("slipstream cannot be negative")
+	}
+	if *weather != sim.WeatherDry && *weather != sim.WeatherDamp && *weather != sim.WeatherWet {
+		log.Fatal("weather must be dry, damp or wet")
+	}
+
+	cfg := sim.BatchConfig{}
+	cfg.Race = sim.DefaultConfig()
+	cfg.Race.Laps = *lapNumber
+	cfg.Race.Seed = *seed
+	cfg.Race.IncidentChance = *incidents
+	cfg.Race.CollisionChance = *crashes
+	cfg.Race.SlipstreamDistance = *slipstream
+	cfg.Race.Weather = *weather
+	cfg.Race.WeatherChanges = *rain
+	cfg.Entries = entries
+	cfg.Races = *races
+	cfg.Workers = *workers
+
+	started := time.Now()
+	stats := sim.RunBatch(cfg)
+	fmt.Printf("Simulated %d races of %d laps in %s (seed %d) 🏁\n\n", cfg.Races, cfg.Race.Laps, time.Since(started).Round(time.Millisecond), cfg.Race.Seed)
+
+	write_table(os.Stdout, stats)
+
+	if *csvPath == "-" {
+		fmt.Println()
+		err = write_csv(os.Stdout, stats)
+	} else if *csvPath != "" {
+		var file *os.File
+		if file, err = os.Create(*csvPath); err == nil {
+			err = write_csv(file, stats)
+			file.Close()
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,304 @@
+package telemetry
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// the columnar format starts with a magic string and a version, then describes its columns
+// with their name and type, and then holds the rows in groups where each column is stored
+// on its own: a whole group of times, then a whole group of racers and so on
+const (
+	columnar_magic   = "RTLM"
+	columnar_version = 1
+	group_size       = 4096    // rows buffered before a group is written
+	max_string       = 1 << 20 // longest string a reader accepts, so a broken file cannot use up the memory
+	max_group        = 1 << 20 // most rows in a group a reader accepts
+)
+
+// column types of the columnar format
+const (
+	type_uvarint = 'u' // unsigned varint
+	type_float64 = 'd' // little endian 64-bit float
+	type_float32 = 'f' // little endian 32-bit float
+	type_string  = 's' // varint length followed by the bytes
+	type_key     = 'k' // varint index into the group's dictionary of racer names
+)
+
+// types of the columns, in the same order as their names
+var column_types = []byte{type_uvarint, type_float64, type_key, type_uvarint, type_float32, type_float32, type_float32,
+	type_uvarint, type_float32, type_float32, type_string}
+
+// type columnar_writer: buffers rows and writes them a group of columns at a time
+type columnar_writer struct {
+	out    *bufio.Writer
+	rows   []Row
+	header bool // the magic and the columns have been written
+}
+
+// func new_columnar_writer: creates a columnar telemetry writer
+// input: the writer to send the output to
+// output: a pointer to a columnar_writer object
+func new_columnar_writer(w io.Writer) *columnar_writer {
+	return &columnar_writer{out: bufio.NewWriter(w)}
+}
+
+// func Write: buffers rows, writing a group every time enough of them are buffered
+// input: the rows
+// output: an error if a group could not be written
+func (w *columnar_writer) Write(rows []Row) error {
+	w.rows = append(w.rows, rows...)
+	if len(w.rows) < group_size {
+		return nil
+	}
+	return w.flush()
+}
+
+// func Close: writes the rows still buffered
+// input: none
+// output: an error if the output could not be written
+func (w *columnar_writer) Close() error {
+	return w.flush()
+}
+
+// func flush: writes the buffered rows as a group, and the header before the first group
+// input: none
+// output: an error if the output could not be written
+func (w *columnar_writer) flush() error {
+	if !w.header {
+		w.header = true
+		w.out.WriteString(columnar_magic)
+		w.out.WriteByte(columnar_version)
+		put_uvarint(w.out, uint64(len(columns)))
+		for i, name := range columns {
+			put_string(w.out, name)
+			w.out.WriteByte(column_types[i])
+		}
+	}
+
+	if len(w.rows) > 0 {
+		w.write_group(w.rows)
+		w.rows = w.rows[:0]
+	}
+
+	return w.out.Flush()
+}
+
+// func write_group: writes a group of rows one column after the other
+// input: the rows of the group
+// output: none (errors are kept by the buffered writer until it is flushed)
+func (w *columnar_writer) write_group(rows []Row) {
+	out := w.out
+	put_uvarint(out, uint64(len(rows)))
+
+	// the racer names are stored once per group and the rows point at them
+	keys := map[string]uint64{}
+	names := []string{}
+	for _, row := range rows {
+		if _, ok := keys[row.Racer]; !ok {
+			keys[row.Racer] = uint64(len(names))
+			names = append(names, row.Racer)
+		}
+	}
+	put_uvarint(out, uint64(len(names)))
+	for _, name := range names {
+		put_string(out, name)
+	}
+
+	for _, row := range rows {
+		put_uvarint(out, uint64(row.Race))
+	}
+	for _, row := range rows {
+		binary.Write(out, binary.LittleEndian, row.Time)
+	}
+	for _, row := range rows {
+		put_uvarint(out, keys[row.Racer])
+	}
+	for _, row := range rows {
+		put_uvarint(out, uint64(row.Lap))
+	}
+	for _, row := range rows {
+		binary.Write(out, binary.LittleEndian, float32(row.Position))
+	}
+	for _, row := range rows {
+		binary.Write(out, binary.LittleEndian, float32(row.Distance))
+	}
+	for _, row := range rows {
+		binary.Write(out, binary.LittleEndian, float32(row.Speed))
+	}
+	for _, row := range rows {
+		put_uvarint(out, uint64(row.Lane))
+	}
+	for _, row := range rows {
+		binary.Write(out, binary.LittleEndian, float32(row.Throttle))
+	}
+	for _, row := range rows {
+		binary.Write(out, binary.LittleEndian, float32(row.Brake))
+	}
+	for _, row := range rows {
+		put_string(out, row.Events)
+	}
+}
+
+// func ReadColumnar: reads back the rows of a columnar telemetry file
+// input: the reader of the file
+// output: the rows, or an error if the file is not a telemetry file of this version
+func ReadColumnar(r io.Reader) ([]Row, error) {
+	in := bufio.NewReader(r)
+
+	magic := make([]byte, len(columnar_magic)+1)
+	if _, err := io.ReadFull(in, magic); err != nil {
+		return nil, err
+	}
+	if string(magic[:len(columnar_magic)]) != columnar_magic || magic[len(columnar_magic)] != columnar_version {
+		return nil, errors.New("not a version 1 telemetry file")
+	}
+
+	// the columns have to be the ones this version writes
+	count, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, err
+	}
+	if count != uint64(len(columns)) {
+		return nil, fmt.Errorf("expected %d columns, the file has %d", len(columns), count)
+	}
+	for i := range columns {
+		name, err := read_string(in)
+		if err != nil {
+			return nil, err
+		}
+		kind, err := in.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if name != columns[i] || kind != column_types[i] {
+			return nil, fmt.Errorf("unexpected column %q of type %c", name, kind)
+		}
+	}
+
+	rows := []Row{}
+	for {
+		group, err := read_group(in)
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, group...)
+	}
+}
+
+// func read_group: reads a group of rows one column after the other
+// input: the reader, placed at the start of a group
+// output: the rows, io.EOF if there are no more groups or another error if the group is cut short
+func read_group(in *bufio.Reader) ([]Row, error) {
+	n, err := binary.ReadUvarint(in)
+	if err != nil {
+		return nil, err
+	}
+	if n > max_group {
+		return nil, fmt.Errorf("group of %d rows is too big", n)
+	}
+
+	// any error past the row count means the group is cut short
+	var group_err error
+	uvarint := func() uint64 {
+		v, err := binary.ReadUvarint(in)
+		group_err = errors.Join(group_err, err)
+		return v
+	}
+	double := func() float64 {
+		var v float64
+		group_err = errors.Join(group_err, binary.Read(in, binary.LittleEndian, &v))
+		return v
+	}
+	single := func() float64 {
+		var v float32
+		group_err = errors.Join(group_err, binary.Read(in, binary.LittleEndian, &v))
+		return float64(v)
+	}
+	text := func() string {
+		v, err := read_string(in)
+		group_err = errors.Join(group_err, err)
+		return v
+	}
+
+	names := make([]string, min(uvarint(), n))
+	for i := range names {
+		names[i] = text()
+	}
+	if group_err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	rows := make([]Row, n)
+	for i := range rows {
+		rows[i].Race = int(uvarint())
+	}
+	for i := range rows {
+		rows[i].Time = double()
+	}
+	for i := range rows {
+		if key := uvarint(); key < uint64(len(names)) {
+			rows[i].Racer = names[key]
+		}
+	}
+	for i := range rows {
+		rows[i].Lap = int(uvarint())
+	}
+	for i := range rows {
+		rows[i].Position = single()
+	}
+	for i := range rows {
+		rows[i].Distance = single()
+	}
+	for i := range rows {
+		rows[i].Speed = single()
+	}
+	for i := range rows {
+		rows[i].Lane = int(uvarint())
+	}
+	for i := range rows {
+		rows[i].Throttle = single()
+	}
+	for i := range rows {
+		rows[i].Brake = single()
+	}
+	for i := range rows {
+		rows[i].Events = text()
+	}
+
+	if group_err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return rows, nil
+}
+
+// func put_uvarint: writes an unsigned varint
+func put_uvarint(out *bufio.Writer, v uint64) {
+	out.Write(binary.AppendUvarint(nil, v))
+}
+
+// func put_string: writes a string as its varint length followed by its bytes
+func put_string(out *bufio.Writer, s string) {
+	put_uvarint(out, uint64(len(s)))
+	out.WriteString(s)
+}
+
+// func read_string: reads a string written by put_string
+func read_string(in *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(in)
+	if err != nil {
+		return "", err
+	}
+	if n > max_string {
+		return "", errors.New("string too long")
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(in, buf)
+	return string(buf), err
+}
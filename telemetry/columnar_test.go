@@ -0,0 +1,148 @@
+package telemetry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// func sample_rows: makes the rows of a few steps of a race, with floats the columnar format
+// keeps exactly
+// input: the number of steps and of racers
+// output: the rows of every step, one slice for each step
+func sample_rows(steps int, racers int) [][]Row {
+	all := [][]Row{}
+	for step := 0; step < steps; step++ {
+		rows := []Row{}
+		for r := 0; r < racers; r++ {
+			row := Row{
+				Race:     1 + step/1000,
+				Time:     float64(step) * 0.05,
+				Racer:    fmt.Sprintf("Racer %d", r),
+				Lap:      1 + step/200,
+				Position: float64(float32(float64(step%200) * 2.5)),
+				Distance: float64(float32(float64(step) * 2.5)),
+				Speed:    float64(float32(30 + float64(r)*0.1)),
+				Lane:     1 + r%6,
+				Throttle: float64(float32(0.25 * float64(r%5))),
+				Brake:    float64(float32(0.5 * float64(r%3))),
+			}
+			if step%50 == 0 {
+				row.Events = "lap|sector"
+			}
+			rows = append(rows, row)
+		}
+		all = append(all, rows)
+	}
+	return all
+}
+
+// func write_columnar: writes rows to a columnar file in memory, one Write call for each step
+// input: the test and the rows of every step
+// output: the bytes of the file
+func write_columnar(t *testing.T, steps [][]Row) []byte {
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatColumnar, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rows := range steps {
+		if err := w.Write(rows); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// the rows read back are the ones written, across several groups
+func TestColumnarRoundTrip(t *testing.T) {
+	cases := []struct {
+		steps  int
+		racers int
+	}{
+		{0, 0},
+		{1, 1},
+		{10, 4},
+		{2500, 5}, // a few groups, the last one not full
+	}
+
+	for _, c := range cases {
+		steps := sample_rows(c.steps, c.racers)
+		want := []Row{}
+		for _, rows := range steps {
+			want = append(want, rows...)
+		}
+
+		got, err := ReadColumnar(bytes.NewReader(write_columnar(t, steps)))
+		if err != nil {
+			t.Fatalf("%d steps of %d racers: %v", c.steps, c.racers, err)
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%d steps of %d racers: read %d rows, want %d", c.steps, c.racers, len(got), len(want))
+		}
+		for i := range want {
+			if !reflect.DeepEqual(got[i], want[i]) {
+				t.Fatalf("%d steps of %d racers: row %d is %+v, want %+v", c.steps, c.racers, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+// a file cut short anywhere but between two groups is an error, not fewer rows
+func TestColumnarTruncated(t *testing.T) {
+	header := len(write_columnar(t, nil))
+	file := write_columnar(t, sample_rows(10, 3))
+
+	for size := 0; size < len(file); size++ {
+		rows, err := ReadColumnar(bytes.NewReader(file[:size]))
+		if size == header {
+			if err != nil || len(rows) != 0 {
+				t.Errorf("header only: %d rows and %v, want no rows and no error", len(rows), err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("cut to %d of %d bytes: read %d rows without an error", size, len(file), len(rows))
+		}
+	}
+}
+
+// a file that is not a telemetry file of this version, or whose sizes make no sense, is an error
+func TestColumnarCorrupt(t *testing.T) {
+	file := write_columnar(t, sample_rows(10, 3))
+	header := len(write_columnar(t, nil))
+
+	// func corrupt: a copy of the file changed by a function
+	corrupt := func(change func([]byte) []byte) []byte {
+		return change(append([]byte(nil), file...))
+	}
+
+	cases := []struct {
+		name string
+		file []byte
+	}{
+		{"magic", corrupt(func(b []byte) []byte { b[0] = 'X'; return b })},
+		{"version", corrupt(func(b []byte) []byte { b[len(columnar_magic)] = columnar_version + 1; return b })},
+		{"column count", corrupt(func(b []byte) []byte { b[len(columnar_magic)+1]++; return b })},
+		{"column name", corrupt(func(b []byte) []byte { b[len(columnar_magic)+3] = 'X'; return b })},
+		{"huge group", corrupt(func(b []byte) []byte { return binary.AppendUvarint(b[:header], max_group+1) })},
+		{"huge string", corrupt(func(b []byte) []byte {
+			// a group of one row whose only racer name is too long to be real
+			b = binary.AppendUvarint(b[:header], 1)
+			b = binary.AppendUvarint(b, 1)
+			return binary.AppendUvarint(b, max_string+1)
+		})},
+		{"csv", []byte("race,time,racer\n1,0.05,Ana\n")},
+	}
+
+	for _, c := range cases {
+		if rows, err := ReadColumnar(bytes.NewReader(c.file)); err == nil {
+			t.Errorf("%s: read %d rows without an error", c.name, len(rows))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package telemetry
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+)
+
+// names of the columns, in the order they are written
+var columns = []string{"race", "time", "racer", "lap", "position", "distance", "speed", "lane", "throttle", "brake", "events"}
+
+// type csv_writer: writes the rows as CSV with a header row
+type csv_writer struct {
+	out    *csv.Writer
+	header bool // the header row has been written
+}
+
+// func new_csv_writer: creates a CSV telemetry writer
+// input: the writer to send the output to
+// output: a pointer to a csv_writer object
+func new_csv_writer(w io.Writer) *csv_writer {
+	return &csv_writer{out: csv.NewWriter(w)}
+}
+
+// func Write: adds rows to the CSV output, the header goes before the first ones
+// input: the rows
+// output: an error if the rows could not be written
+func (w *csv_writer) Write(rows []Row) error {
+	if !w.header {
+		w.header = true
+		w.out.Write(columns)
+	}
+
+	format := func(v float64) string { return strconv.FormatFloat(v, 'f', 3, 64) }
+	for _, row := range rows {
+		w.out.Write([]string{strconv.Itoa(row.Race), format(row.Time), row.Racer, strconv.Itoa(row.Lap), format(row.Position),
+			format(row.Distance), format(row.Speed), strconv.Itoa(row.Lane), format(row.Throttle), format(row.Brake), row.Events})
+	}
+
+	w.out.Flush()
+	return w.out.Error()
+}
+
+// func Close: flushes the CSV output
+// input: none
+// output: an error if the output could not be written
+func (w *csv_writer) Close() error {
+	w.out.Flush()
+	return w.out.Error()
+}
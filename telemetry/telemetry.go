@@ -0,0 +1,81 @@
+// Package telemetry records the state of every racer on every simulation step, so a race
+// can be analysed once it is over. Rows are written as CSV or in a compact binary
+// columnar format, and the columnar files can be read back into rows.
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"racer/sim"
+)
+
+// output formats
+const (
+	FormatCSV      = "csv"
+	FormatColumnar = "columnar"
+)
+
+// type Row: the state of a racer after a simulation step
+type Row struct {
+	Race     int     // number of the race in the session, from one
+	Time     float64 // race time, in seconds
+	Racer    string
+	Lap      int
+	Position float64 // meters covered on the current lap
+	Distance float64 // meters covered since the start of the race
+	Speed    float64 // in m/s
+	Lane     int
+	Throttle float64 // fraction of the top speed the racer was driving at, between [0, 1]
+	Brake    float64 // fraction of the braking force applied, between [0, 1]
+	Events   string  // kinds of the events of the racer and of the whole race during the step, separated by |
+}
+
+// type Writer: a telemetry output
+type Writer interface {
+	Write(rows []Row) error // adds rows to the output
+	Close() error           // writes whatever is buffered, it does not close the underlying writer
+}
+
+// func NewWriter: creates a telemetry writer of the given format
+// input: the format and the writer to send the output to
+// output: a Writer object, or an error if the format does not exist
+func NewWriter(format string, w io.Writer) (Writer, error) {
+	switch format {
+	case FormatCSV:
+		return new_csv_writer(w), nil
+	case FormatColumnar:
+		return new_columnar_writer(w), nil
+	}
+	return nil, fmt.Errorf("unknown telemetry format %q, use %s or %s", format, FormatCSV, FormatColumnar)
+}
+
+// func Rows: turns the state of a race after a step into telemetry rows, one for each racer
+// input: the race number, a snapshot of the race taken after the step and the events of the step
+// output: the rows
+func Rows(race int, snapshot sim.Snapshot, events []sim.Event) []Row {
+	// the events are keyed by racer id, the events of the whole race show up on every racer's row
+	kinds := map[string][]string{}
+	for _, event := range events {
+		kinds[event.Racer] = append(kinds[event.Racer], event.Kind)
+	}
+
+	rows := []Row{}
+	for _, racer := range snapshot.Racers {
+		rows = append(rows, Row{
+			Race:     race,
+			Time:     snapshot.Elapsed,
+			Racer:    racer.Name,
+			Lap:      racer.CurrentLap,
+			Position: racer.Position,
+			Distance: racer.Distance,
+			Speed:    racer.Speed,
+			Lane:     racer.Lane,
+			Throttle: racer.Throttle,
+			Brake:    racer.Brake,
+			Events:   strings.Join(append(kinds[racer.ID], kinds[""]...), "|"),
+		})
+	}
+	return rows
+}